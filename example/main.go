@@ -26,13 +26,19 @@ func main() {
 	_ = os.Remove(localSocket)
 
 	sshAgent := sshagent.NewSSHAgent(ctx, upstreamSocket, localSocket)
+	sshAgent.SetUpstreamResolver(system.GetSSHAgent)
 
-	// find local private keys ~/.ssh
+	// find local private keys ~/.ssh, with the certificates of ~/.ssh/config
 	{
-		keys := identity.FindPrivateKeys()
-		sshAgent.LoadLocalKeys(keys...)
+		keys := identity.DiscoverKeys()
+		for _, result := range sshAgent.LoadKeys(keys...) {
+			fmt.Println(result)
+		}
 	}
 
+	// reload local keys when ~/.ssh changes
+	sshAgent.WatchLocalKeys(sshagent.WatchOptions{})
+
 	fmt.Printf("start listening: %q", localSocket)
 
 	if err := sshAgent.Serve(); err != nil {
@@ -0,0 +1,125 @@
+package identity
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// PermissionPolicy what to do with a key file failing the permission audit
+type PermissionPolicy int
+
+const (
+	// PermissionWarn use the key, and report the findings
+	PermissionWarn PermissionPolicy = iota
+	// PermissionRefuse skip the key, like OpenSSH does
+	PermissionRefuse
+	// PermissionIgnore use the key without auditing it
+	PermissionIgnore
+)
+
+// ErrInsecurePermissions the key file was refused because of its permissions
+var ErrInsecurePermissions = errors.New("insecure key file permissions")
+
+// PermissionIssue the kind of a permission violation
+type PermissionIssue string
+
+const (
+	// PermissionGroupAccessible the key file can be read or written by the group
+	PermissionGroupAccessible PermissionIssue = "group-accessible"
+	// PermissionWorldAccessible the key file can be read or written by everyone
+	PermissionWorldAccessible PermissionIssue = "world-accessible"
+	// PermissionDirWritable the directory holding the key can be written by the group or everyone
+	PermissionDirWritable PermissionIssue = "directory-writable"
+	// PermissionWrongOwner the file or directory is not owned by the current user
+	PermissionWrongOwner PermissionIssue = "wrong-owner"
+)
+
+// PermissionFinding one permission violation of a key file or its directory
+type PermissionFinding struct {
+	Path  string
+	Issue PermissionIssue
+	Mode  fs.FileMode
+}
+
+func (f PermissionFinding) String() string {
+	return fmt.Sprintf("%s: %s (%04o)", f.Path, f.Issue, f.Mode.Perm())
+}
+
+// FormatFindings join the findings into one line
+func FormatFindings(findings []PermissionFinding) string {
+	s := make([]string, 0, len(findings))
+	for _, f := range findings {
+		s = append(s, f.String())
+	}
+
+	return strings.Join(s, "; ")
+}
+
+// AuditKeyFile check the mode and ownership of the key file and of the directories holding it, up to ~/.ssh.
+// The key must not be accessible by group or others, the directory must not be writable by them,
+// and both must be owned by the current user. Platforms without unix permissions report nothing.
+func AuditKeyFile(path string) []PermissionFinding {
+	if !permissionsSupported {
+		return nil
+	}
+
+	var findings []PermissionFinding
+
+	if fi, err := os.Stat(path); err == nil {
+		mode := fi.Mode()
+		if mode.Perm()&0o070 != 0 {
+			findings = append(findings, PermissionFinding{Path: path, Issue: PermissionGroupAccessible, Mode: mode})
+		}
+		if mode.Perm()&0o007 != 0 {
+			findings = append(findings, PermissionFinding{Path: path, Issue: PermissionWorldAccessible, Mode: mode})
+		}
+		if !ownedByCurrentUser(fi) {
+			findings = append(findings, PermissionFinding{Path: path, Issue: PermissionWrongOwner, Mode: mode})
+		}
+	}
+
+	for _, dir := range keyDirs(path) {
+		fi, err := os.Stat(dir)
+		if err != nil {
+			continue
+		}
+
+		mode := fi.Mode()
+		// sticky directories like /tmp only let owners replace their files
+		if mode.Perm()&0o022 != 0 && mode&fs.ModeSticky == 0 {
+			findings = append(findings, PermissionFinding{Path: dir, Issue: PermissionDirWritable, Mode: mode})
+		}
+		if !ownedByCurrentUser(fi) {
+			findings = append(findings, PermissionFinding{Path: dir, Issue: PermissionWrongOwner, Mode: mode})
+		}
+	}
+
+	return findings
+}
+
+// keyDirs return the directory holding the key, and its parents up to ~/.ssh when the key lies in ~/.ssh
+func keyDirs(path string) []string {
+	dir := filepath.Dir(filepath.Clean(path))
+	dirs := []string{dir}
+
+	homeDir, err := os.UserHomeDir()
+	if err != nil {
+		return dirs
+	}
+
+	sshDir := filepath.Join(homeDir, ".ssh")
+	if !strings.HasPrefix(dir, sshDir+string(filepath.Separator)) {
+		return dirs
+	}
+
+	for dir != sshDir {
+		dir = filepath.Dir(dir)
+		dirs = append(dirs, dir)
+	}
+
+	return dirs
+}
@@ -0,0 +1,20 @@
+//go:build unix
+
+package identity
+
+import (
+	"os"
+	"syscall"
+)
+
+const permissionsSupported = true
+
+// ownedByCurrentUser report whether the file is owned by the current user or root
+func ownedByCurrentUser(fi os.FileInfo) bool {
+	st, ok := fi.Sys().(*syscall.Stat_t)
+	if !ok {
+		return true
+	}
+
+	return int(st.Uid) == os.Getuid() || st.Uid == 0
+}
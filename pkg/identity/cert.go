@@ -0,0 +1,57 @@
+package identity
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+)
+
+var (
+	// ErrCertificateExpired the certificate ValidBefore has passed
+	ErrCertificateExpired = errors.New("certificate expired")
+	// ErrCertificateNotYetValid the certificate ValidAfter is in the future
+	ErrCertificateNotYetValid = errors.New("certificate not yet valid")
+)
+
+// CertificatePath return the -cert.pub file paired with the private key file, empty when none exists
+func CertificatePath(keyPath string) string {
+	certPath := keyPath + "-cert.pub"
+	if fi, err := os.Stat(certPath); err != nil || !fi.Mode().IsRegular() {
+		return ""
+	}
+
+	return certPath
+}
+
+// ReadCertificate read an OpenSSH certificate file, in authorized_keys format
+func ReadCertificate(path string) (*ssh.Certificate, error) {
+	pub, _, err := readPublicKeyFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	cert, ok := pub.(*ssh.Certificate)
+	if !ok {
+		return nil, fmt.Errorf("%q is not a certificate", path)
+	}
+
+	return cert, nil
+}
+
+// CheckCertificateValidity check the validity window of the certificate at the given time
+func CheckCertificateValidity(cert *ssh.Certificate, now time.Time) error {
+	unix := uint64(now.Unix())
+
+	if unix < cert.ValidAfter {
+		return fmt.Errorf("%w: valid after %s", ErrCertificateNotYetValid, time.Unix(int64(cert.ValidAfter), 0))
+	}
+
+	if cert.ValidBefore != ssh.CertTimeInfinity && unix >= cert.ValidBefore {
+		return fmt.Errorf("%w: valid before %s", ErrCertificateExpired, time.Unix(int64(cert.ValidBefore), 0))
+	}
+
+	return nil
+}
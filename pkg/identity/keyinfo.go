@@ -0,0 +1,207 @@
+package identity
+
+import (
+	"crypto/dsa"
+	"crypto/ecdsa"
+	"crypto/rsa"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"os"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// KeyInfo describe a private key file
+type KeyInfo struct {
+	Path string
+	// Type the ssh key type, e.g. ssh-ed25519, empty when the public key is unknown
+	Type string
+	// Bits the key size in bits
+	Bits int
+	// Fingerprint the SHA256 fingerprint, empty when the public key is unknown
+	Fingerprint string
+	// Comment from the .pub file or the key body
+	Comment   string
+	PublicKey ssh.PublicKey
+	// Encrypted the key is protected by a passphrase
+	Encrypted bool
+	// CertificatePath the matching -cert.pub file or CertificateFile of ~/.ssh/config, empty when none exists
+	CertificatePath string
+	Mode            os.FileMode
+	ModTime         time.Time
+	// Permissions the findings of AuditKeyFile, empty when the key file is safe
+	Permissions []PermissionFinding
+}
+
+// InspectKey read the metadata of a private key file, without decrypting it
+func InspectKey(path string) (KeyInfo, error) {
+	fi, err := os.Stat(path)
+	if err != nil {
+		return KeyInfo{}, err
+	}
+
+	content, err := os.ReadFile(path)
+	if err != nil {
+		return KeyInfo{}, err
+	}
+
+	return inspectKey(path, content, fi)
+}
+
+func inspectKey(path string, content []byte, fi os.FileInfo) (KeyInfo, error) {
+	info := KeyInfo{
+		Path:    path,
+		Mode:    fi.Mode(),
+		ModTime: fi.ModTime(),
+	}
+
+	privateKey, err := ParseRawPrivateKey(content)
+	var missing *ssh.PassphraseMissingError
+	switch {
+	case errors.As(err, &missing):
+		info.Encrypted = true
+		if pub, _, err := PublicKey(path, content); err == nil {
+			info.setPublicKey(pub)
+		}
+	case err != nil:
+		return KeyInfo{}, fmt.Errorf("failed to parse private key %q: %w", path, err)
+	default:
+		signer, err := ssh.NewSignerFromKey(privateKey)
+		if err != nil {
+			return KeyInfo{}, fmt.Errorf("failed to parse private key %q: %w", path, err)
+		}
+		info.setPublicKey(signer.PublicKey())
+	}
+
+	info.Comment = KeyComment(path, content)
+
+	info.CertificatePath = CertificatePath(path)
+
+	info.Permissions = AuditKeyFile(path)
+
+	return info, nil
+}
+
+func (info *KeyInfo) setPublicKey(pub ssh.PublicKey) {
+	info.PublicKey = pub
+	info.Type = pub.Type()
+	info.Fingerprint = ssh.FingerprintSHA256(pub)
+	info.Bits = keyBits(pub)
+}
+
+// keyBits return the size of the public key in bits, zero when unknown
+func keyBits(pub ssh.PublicKey) int {
+	if pub.Type() == ssh.KeyAlgoED25519 || pub.Type() == ssh.KeyAlgoSKED25519 {
+		return 256
+	}
+
+	cpk, ok := pub.(ssh.CryptoPublicKey)
+	if !ok {
+		return 0
+	}
+
+	switch k := cpk.CryptoPublicKey().(type) {
+	case *rsa.PublicKey:
+		return k.N.BitLen()
+	case *ecdsa.PublicKey:
+		return k.Curve.Params().BitSize
+	case *dsa.PublicKey:
+		return k.P.BitLen()
+	}
+
+	return 0
+}
+
+const opensshKeyMagic = "openssh-key-v1\x00"
+
+// opensshKeyFields the number of length-prefixed fields between key type and comment,
+// in the private section of the OpenSSH key format
+var opensshKeyFields = map[string]int{
+	ssh.KeyAlgoED25519:  2,
+	ssh.KeyAlgoRSA:      6,
+	ssh.KeyAlgoECDSA256: 3,
+	ssh.KeyAlgoECDSA384: 3,
+	ssh.KeyAlgoECDSA521: 3,
+	ssh.KeyAlgoDSA:      5,
+}
+
+// KeyComment return the comment of a private key file,
+// read from the adjacent .pub file, the header of a PuTTY key or the body of an unencrypted OpenSSH key
+func KeyComment(path string, content []byte) string {
+	if _, comment, err := readPublicKeyFile(path + ".pub"); err == nil && comment != "" {
+		return comment
+	}
+
+	if isPPK(content) {
+		if k, err := readPPK(content); err == nil {
+			return k.comment
+		}
+		return ""
+	}
+
+	return opensshComment(content)
+}
+
+func opensshComment(content []byte) string {
+	block, _ := pem.Decode(content)
+	if block == nil || block.Type != "OPENSSH PRIVATE KEY" || len(block.Bytes) < len(opensshKeyMagic) {
+		return ""
+	}
+
+	var header struct {
+		CipherName   string
+		KdfName      string
+		KdfOpts      string
+		NumKeys      uint32
+		PubKey       []byte
+		PrivKeyBlock []byte
+	}
+	if err := ssh.Unmarshal(block.Bytes[len(opensshKeyMagic):], &header); err != nil || header.CipherName != "none" {
+		return ""
+	}
+
+	// check1, check2
+	r := header.PrivKeyBlock
+	if len(r) < 8 {
+		return ""
+	}
+	r = r[8:]
+
+	keyType, r, ok := parseWireString(r)
+	if !ok {
+		return ""
+	}
+
+	fields, ok := opensshKeyFields[string(keyType)]
+	if !ok {
+		return ""
+	}
+
+	for i := 0; i < fields; i++ {
+		if _, r, ok = parseWireString(r); !ok {
+			return ""
+		}
+	}
+
+	comment, _, ok := parseWireString(r)
+	if !ok {
+		return ""
+	}
+
+	return string(comment)
+}
+
+func parseWireString(in []byte) (out, rest []byte, ok bool) {
+	if len(in) < 4 {
+		return nil, nil, false
+	}
+
+	n := uint64(in[0])<<24 | uint64(in[1])<<16 | uint64(in[2])<<8 | uint64(in[3])
+	if uint64(len(in)-4) < n {
+		return nil, nil, false
+	}
+
+	return in[4 : 4+n], in[4+n:], true
+}
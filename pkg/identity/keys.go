@@ -1,6 +1,7 @@
 package identity
 
 import (
+	"io/fs"
 	"os"
 	"path/filepath"
 	"strings"
@@ -8,65 +9,278 @@ import (
 	"golang.org/x/crypto/ssh"
 )
 
-// FindPrivateKeys finds all private keys in ~/.ssh
+const (
+	// DefaultMaxKeySize larger files are not considered private keys
+	DefaultMaxKeySize = 1024 * 50
+	// UnlimitedDepth search all subdirectories of a root, see DiscoverOptions.MaxDepth
+	UnlimitedDepth = -1
+)
+
+// DiscoverOptions control where and how private keys are discovered
+type DiscoverOptions struct {
+	// Roots the directories searched after ~/.ssh
+	Roots []string
+	// Include glob patterns matched against the file name or path, empty include all files
+	Include []string
+	// Exclude glob patterns matched against the file or directory name or path,
+	// in addition to the well known files like known_hosts
+	Exclude []string
+	// MaxDepth the subdirectory levels searched below a root, zero search the root only,
+	// 1 the root and its subdirectories, UnlimitedDepth or any negative value search all levels
+	MaxDepth int
+	// FollowSymlinks read symlinked files and search symlinked directories, otherwise symlinks are skipped
+	FollowSymlinks bool
+	// MaxSize larger files are skipped, zero use DefaultMaxKeySize
+	MaxSize int64
+	// SSHConfig add the IdentityFile and CertificateFile entries of ~/.ssh/config
+	SSHConfig bool
+	// Permissions PermissionIgnore drop the findings of the permission audit, otherwise they are kept in KeyInfo.Permissions.
+	// Keys failing the audit are returned with PermissionRefuse too, they are refused when loaded, with the findings in the load report.
+	Permissions PermissionPolicy
+}
+
+// DefaultDiscoverOptions return the options used by DiscoverKeys
+func DefaultDiscoverOptions() DiscoverOptions {
+	return DiscoverOptions{
+		MaxDepth:       UnlimitedDepth,
+		FollowSymlinks: true,
+		MaxSize:        DefaultMaxKeySize,
+		SSHConfig:      true,
+	}
+}
+
+// ignoreFiles well known files in ~/.ssh which are never private keys
+var ignoreFiles = []string{
+	"authorized_keys",
+	"known_hosts",
+	"known_hosts.old",
+	"config",
+	".DS_Store",
+	"allowed_signers",
+}
+
+// FindPrivateKeys finds all private keys in ~/.ssh and referenced by ~/.ssh/config
 func FindPrivateKeys() (keys []string) {
-	keys = make([]string, 0)
+	infos := DiscoverKeys()
+	if infos == nil {
+		return nil
+	}
+
+	keys = make([]string, 0, len(infos))
+	for _, info := range infos {
+		keys = append(keys, info.Path)
+	}
 
+	return keys
+}
+
+// DiscoverKeys finds all private keys in ~/.ssh with their metadata,
+// and the IdentityFile and CertificateFile entries of ~/.ssh/config
+func DiscoverKeys() []KeyInfo {
+	return DiscoverKeysWithOptions(DefaultDiscoverOptions())
+}
+
+// DiscoverKeysWithOptions finds private keys in ~/.ssh and the extra roots with their metadata.
+// Sockets and the ControlPath directories of ~/.ssh/config are always skipped.
+func DiscoverKeysWithOptions(opts DiscoverOptions) []KeyInfo {
 	homeDir, err := os.UserHomeDir()
 	if err != nil {
-		return
+		return nil
 	}
 
-	sshDir := filepath.Join(homeDir, ".ssh")
-	if err = filepath.Walk(sshDir, addPrivateKeyToList(&keys)); err != nil {
-		return nil
+	if opts.MaxSize <= 0 {
+		opts.MaxSize = DefaultMaxKeySize
 	}
 
-	return keys
+	d := &discoverer{
+		opts:    opts,
+		keys:    make([]KeyInfo, 0),
+		found:   make(map[string]struct{}),
+		visited: make(map[string]struct{}),
+		skip:    make(map[string]struct{}),
+	}
+
+	var config *SSHConfig
+	if configPath, err := UserSSHConfigPath(); err == nil {
+		config, _ = ParseSSHConfig(configPath)
+	}
+	if config != nil {
+		for _, dir := range config.ControlDirs {
+			d.skip[dir] = struct{}{}
+		}
+	}
+
+	roots := append([]string{filepath.Join(homeDir, ".ssh")}, opts.Roots...)
+	for _, root := range roots {
+		d.walkRoot(filepath.Clean(root))
+	}
+
+	if opts.SSHConfig && config != nil {
+		d.addConfigKeys(config)
+	}
+
+	return d.keys
+}
+
+type discoverer struct {
+	opts  DiscoverOptions
+	keys  []KeyInfo
+	found map[string]struct{}
+	// visited the resolved directories already searched, to break symlink loops
+	visited map[string]struct{}
+	// skip the directories never searched
+	skip map[string]struct{}
+}
+
+func (d *discoverer) walkRoot(root string) {
+	fi, err := os.Stat(root)
+	if err != nil || !fi.IsDir() {
+		return
+	}
+
+	d.walkDir(root, 0)
 }
 
-func addPrivateKeyToList(keys *[]string) func(path string, info os.FileInfo, err error) error {
-	ignoreFiles := []string{
-		"authorized_keys",
-		"known_hosts",
-		"known_hosts.old",
-		"config",
-		".DS_Store",
-		"allowed_signers",
+func (d *discoverer) walkDir(dir string, depth int) {
+	resolved, err := filepath.EvalSymlinks(dir)
+	if err != nil {
+		return
+	}
+	if _, ok := d.visited[resolved]; ok {
+		return
+	}
+	d.visited[resolved] = struct{}{}
+
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return
 	}
 
-	return func(path string, info os.FileInfo, err error) error {
+	for _, entry := range entries {
+		path := filepath.Join(dir, entry.Name())
+		if d.excluded(path) {
+			continue
+		}
+
+		info, err := entry.Info()
 		if err != nil {
-			return err
+			continue
 		}
 
-		for _, ignore := range ignoreFiles {
-			if info.Name() == ignore {
-				return nil
+		if info.Mode()&fs.ModeSymlink != 0 {
+			if !d.opts.FollowSymlinks {
+				continue
+			}
+
+			if info, err = os.Stat(path); err != nil {
+				continue
 			}
 		}
 
-		if strings.HasSuffix(info.Name(), ".pub") {
-			return nil
+		switch {
+		case info.IsDir():
+			if _, ok := d.skip[path]; ok {
+				continue
+			}
+
+			if d.opts.MaxDepth < 0 || depth < d.opts.MaxDepth {
+				d.walkDir(path, depth+1)
+			}
+		case info.Mode().IsRegular():
+			if d.included(path) {
+				d.addKey(path, info)
+			}
 		}
+	}
+}
 
-		// ignore large files
-		if info.Size() > 1024*50 {
-			return nil
+// excluded report whether the file or directory match the ignore list or an Exclude pattern
+func (d *discoverer) excluded(path string) bool {
+	name := filepath.Base(path)
+	for _, ignore := range ignoreFiles {
+		if name == ignore {
+			return true
 		}
+	}
 
-		content, err := os.ReadFile(path)
-		if err != nil {
-			return nil
+	return matchAny(d.opts.Exclude, path)
+}
+
+func (d *discoverer) included(path string) bool {
+	return len(d.opts.Include) == 0 || matchAny(d.opts.Include, path)
+}
+
+func matchAny(patterns []string, path string) bool {
+	for _, pattern := range patterns {
+		if ok, _ := filepath.Match(pattern, filepath.Base(path)); ok {
+			return true
 		}
 
-		_, err = ssh.ParseRawPrivateKey(content)
-		if err != nil {
-			return nil
+		if ok, _ := filepath.Match(pattern, path); ok {
+			return true
 		}
+	}
 
-		*keys = append(*keys, path)
+	return false
+}
 
-		return nil
+// addKey add the file when it is a private key
+func (d *discoverer) addKey(path string, info os.FileInfo) {
+	if _, ok := d.found[path]; ok {
+		return
+	}
+
+	if strings.HasSuffix(info.Name(), ".pub") {
+		return
+	}
+
+	// ignore large files
+	if info.Size() > d.opts.MaxSize {
+		return
+	}
+
+	content, err := os.ReadFile(path)
+	if err != nil {
+		return
+	}
+
+	// encrypted keys are kept, they are decrypted when loaded
+	keyInfo, err := inspectKey(path, content, info)
+	if err != nil {
+		return
+	}
+
+	if d.opts.Permissions == PermissionIgnore {
+		keyInfo.Permissions = nil
+	}
+
+	d.found[path] = struct{}{}
+	d.keys = append(d.keys, keyInfo)
+}
+
+// addConfigKeys add the IdentityFile keys not found yet,
+// and pair CertificateFile certificates with the keys lacking a -cert.pub file
+func (d *discoverer) addConfigKeys(config *SSHConfig) {
+	for _, path := range config.IdentityFiles {
+		info, err := os.Stat(path)
+		if err != nil || !info.Mode().IsRegular() {
+			continue
+		}
+
+		d.addKey(path, info)
+	}
+
+	for _, path := range config.CertificateFiles {
+		cert, err := ReadCertificate(path)
+		if err != nil {
+			continue
+		}
+
+		fp := ssh.FingerprintSHA256(cert.Key)
+		for i := range d.keys {
+			if d.keys[i].Fingerprint == fp && d.keys[i].CertificatePath == "" {
+				d.keys[i].CertificatePath = path
+			}
+		}
 	}
 }
@@ -0,0 +1,85 @@
+package identity
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/pem"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"testing"
+
+	"golang.org/x/crypto/ssh"
+)
+
+func TestDiscoverKeysMaxDepth(t *testing.T) {
+	home := testHome(t)
+
+	_, priv, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	block, err := ssh.MarshalPrivateKey(priv, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, name := range []string{"id_root", "sub/id_sub", "sub/deep/id_deep"} {
+		writeFile(t, filepath.Join(home, ".ssh", name), string(pem.EncodeToMemory(block)))
+	}
+
+	tests := []struct {
+		maxDepth int
+		want     []string
+	}{
+		{UnlimitedDepth, []string{"id_deep", "id_root", "id_sub"}},
+		{0, []string{"id_root"}},
+		{1, []string{"id_root", "id_sub"}},
+		{2, []string{"id_deep", "id_root", "id_sub"}},
+	}
+
+	for _, tt := range tests {
+		var got []string
+		for _, key := range DiscoverKeysWithOptions(DiscoverOptions{MaxDepth: tt.maxDepth}) {
+			got = append(got, filepath.Base(key.Path))
+		}
+		sort.Strings(got)
+
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("MaxDepth %d: discovered %q, want %q", tt.maxDepth, got, tt.want)
+		}
+	}
+}
+
+func TestDiscoverKeysInsecurePermissions(t *testing.T) {
+	home := testHome(t)
+
+	_, priv, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	block, err := ssh.MarshalPrivateKey(priv, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	file := filepath.Join(home, ".ssh", "id_shared")
+	writeFile(t, file, string(pem.EncodeToMemory(block)))
+	if err = os.Chmod(file, 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	// a refused key is still discovered with its findings, the loader refuse it and report why
+	for _, policy := range []PermissionPolicy{PermissionWarn, PermissionRefuse} {
+		keys := DiscoverKeysWithOptions(DiscoverOptions{Permissions: policy})
+		if len(keys) != 1 || len(keys[0].Permissions) == 0 {
+			t.Errorf("policy %d: discovered %d keys, want the key with its findings", policy, len(keys))
+		}
+	}
+
+	keys := DiscoverKeysWithOptions(DiscoverOptions{Permissions: PermissionIgnore})
+	if len(keys) != 1 || len(keys[0].Permissions) != 0 {
+		t.Errorf("ignore policy: discovered %d keys, want the key without findings", len(keys))
+	}
+}
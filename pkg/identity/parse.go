@@ -0,0 +1,36 @@
+package identity
+
+import "golang.org/x/crypto/ssh"
+
+// ParseRawPrivateKey parse a private key like ssh.ParseRawPrivateKey,
+// and also PuTTY .ppk files (version 2 and 3) and encrypted PKCS#8 PEM keys.
+// An encrypted key return *ssh.PassphraseMissingError.
+func ParseRawPrivateKey(content []byte) (any, error) {
+	return parseRawPrivateKey(content, nil)
+}
+
+// ParseRawPrivateKeyWithPassphrase parse an encrypted private key in any format supported by ParseRawPrivateKey.
+// A wrong passphrase return x509.IncorrectPasswordError.
+func ParseRawPrivateKeyWithPassphrase(content, passphrase []byte) (any, error) {
+	if passphrase == nil {
+		passphrase = []byte{}
+	}
+
+	return parseRawPrivateKey(content, passphrase)
+}
+
+func parseRawPrivateKey(content, passphrase []byte) (any, error) {
+	if isPPK(content) {
+		return parsePPK(content, passphrase)
+	}
+
+	if block := encryptedPKCS8Block(content); block != nil {
+		return parseEncryptedPKCS8(block, passphrase)
+	}
+
+	if passphrase == nil {
+		return ssh.ParseRawPrivateKey(content)
+	}
+
+	return ssh.ParseRawPrivateKeyWithPassphrase(content, passphrase)
+}
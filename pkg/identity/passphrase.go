@@ -0,0 +1,186 @@
+package identity
+
+import (
+	"bytes"
+	"context"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sync"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// DefaultPassphraseAttempts the number of passphrases tried per key file
+const DefaultPassphraseAttempts = 3
+
+// ErrPassphraseUnavailable the provider has no (further) passphrase for the key file
+var ErrPassphraseUnavailable = errors.New("passphrase unavailable")
+
+// PassphraseProvider supply the passphrase of an encrypted private key
+type PassphraseProvider interface {
+	// Passphrase return the passphrase of the key file, attempt start from 1 and grow after every incorrect passphrase.
+	// It should give up when ctx is done, e.g. when the sign request waiting for the key timed out.
+	Passphrase(ctx context.Context, file string, attempt int) ([]byte, error)
+}
+
+// PassphraseFunc adapt an in-process callback to PassphraseProvider
+type PassphraseFunc func(ctx context.Context, file string, attempt int) ([]byte, error)
+
+func (f PassphraseFunc) Passphrase(ctx context.Context, file string, attempt int) ([]byte, error) {
+	return f(ctx, file, attempt)
+}
+
+// EnvPassphrase read the passphrase of every key from an environment variable
+func EnvPassphrase(name string) PassphraseProvider {
+	return PassphraseFunc(func(_ context.Context, _ string, attempt int) ([]byte, error) {
+		val, ok := os.LookupEnv(name)
+		if !ok || attempt > 1 {
+			return nil, ErrPassphraseUnavailable
+		}
+
+		return []byte(val), nil
+	})
+}
+
+// FilePassphrase read the passphrase of every key from a file, the trailing newline is trimmed
+func FilePassphrase(path string) PassphraseProvider {
+	return PassphraseFunc(func(_ context.Context, _ string, attempt int) ([]byte, error) {
+		if attempt > 1 {
+			return nil, ErrPassphraseUnavailable
+		}
+
+		content, err := os.ReadFile(path)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read passphrase file: %w", err)
+		}
+
+		return bytes.TrimRight(content, "\r\n"), nil
+	})
+}
+
+// CommandPassphrase run an SSH_ASKPASS style program with the prompt as last argument,
+// the passphrase is read from its stdout. The program is killed when ctx is done.
+type CommandPassphrase struct {
+	Command string
+	Args    []string
+}
+
+func (c *CommandPassphrase) Passphrase(ctx context.Context, file string, attempt int) ([]byte, error) {
+	prompt := fmt.Sprintf("Enter passphrase for %s:", file)
+	if attempt > 1 {
+		prompt = fmt.Sprintf("Bad passphrase, try again for %s:", file)
+	}
+
+	args := make([]string, 0, len(c.Args)+1)
+	args = append(args, c.Args...)
+	args = append(args, prompt)
+
+	output, err := exec.CommandContext(ctx, c.Command, args...).Output()
+	if err != nil {
+		return nil, fmt.Errorf("%w: %w", ErrPassphraseUnavailable, err)
+	}
+
+	return bytes.TrimRight(output, "\r\n"), nil
+}
+
+// Decrypter parse private keys, asking the provider for the passphrase of encrypted keys.
+// Working passphrases are cached per file for the session.
+type Decrypter struct {
+	provider    PassphraseProvider
+	maxAttempts int
+
+	mu    sync.Mutex
+	cache map[string][]byte
+}
+
+// NewDecrypter create a Decrypter, maxAttempts below 1 use DefaultPassphraseAttempts
+func NewDecrypter(provider PassphraseProvider, maxAttempts int) *Decrypter {
+	if maxAttempts < 1 {
+		maxAttempts = DefaultPassphraseAttempts
+	}
+
+	return &Decrypter{
+		provider:    provider,
+		maxAttempts: maxAttempts,
+		cache:       make(map[string][]byte),
+	}
+}
+
+// ParsePrivateKey parse the private key read from file, the provider is asked for the passphrase until ctx is done.
+// An encrypted key without provider return *ssh.PassphraseMissingError.
+func (d *Decrypter) ParsePrivateKey(ctx context.Context, file string, content []byte) (any, error) {
+	key, err := ParseRawPrivateKey(content)
+	var missing *ssh.PassphraseMissingError
+	if !errors.As(err, &missing) || d == nil || d.provider == nil {
+		return key, err
+	}
+
+	file = filepath.Clean(file)
+	if passphrase, ok := d.cached(file); ok {
+		if key, err := ParseRawPrivateKeyWithPassphrase(content, passphrase); err == nil {
+			return key, nil
+		}
+		d.forget(file)
+	}
+
+	for attempt := 1; attempt <= d.maxAttempts; attempt++ {
+		if err := ctx.Err(); err != nil {
+			return nil, fmt.Errorf("failed to get passphrase for %q: %w", file, err)
+		}
+
+		passphrase, err := d.provider.Passphrase(ctx, file, attempt)
+		if err != nil && !errors.Is(err, ErrPassphraseUnavailable) {
+			err = fmt.Errorf("%w: %w", ErrPassphraseUnavailable, err)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("failed to get passphrase for %q: %w", file, err)
+		}
+
+		key, err := ParseRawPrivateKeyWithPassphrase(content, passphrase)
+		if errors.Is(err, x509.IncorrectPasswordError) {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		d.remember(file, passphrase)
+		return key, nil
+	}
+
+	return nil, fmt.Errorf("failed to decrypt %q after %d attempts: %w", file, d.maxAttempts, x509.IncorrectPasswordError)
+}
+
+func (d *Decrypter) cached(file string) ([]byte, bool) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	passphrase, ok := d.cache[file]
+	return passphrase, ok
+}
+
+func (d *Decrypter) remember(file string, passphrase []byte) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	d.cache[file] = passphrase
+}
+
+func (d *Decrypter) forget(file string) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	delete(d.cache, file)
+}
+
+// Forget drop all cached passphrases
+func (d *Decrypter) Forget() {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	clear(d.cache)
+}
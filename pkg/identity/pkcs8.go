@@ -0,0 +1,164 @@
+package identity
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/des"
+	"crypto/pbkdf2"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/sha512"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"hash"
+
+	"golang.org/x/crypto/ssh"
+)
+
+const (
+	// pkcs8EncryptedBlock the PEM block type of an encrypted PKCS#8 key
+	pkcs8EncryptedBlock = "ENCRYPTED PRIVATE KEY"
+	// pkcs8MaxIterations the PBKDF2 iterations accepted from a key file, bounding the decryption time
+	pkcs8MaxIterations = 10_000_000
+)
+
+var (
+	oidPBES2  = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 5, 13}
+	oidPBKDF2 = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 5, 12}
+
+	pbkdf2PRFs = map[string]func() hash.Hash{
+		"1.2.840.113549.2.7":  sha1.New,
+		"1.2.840.113549.2.9":  sha256.New,
+		"1.2.840.113549.2.10": sha512.New384,
+		"1.2.840.113549.2.11": sha512.New,
+	}
+
+	pbes2Ciphers = map[string]struct {
+		keyLen   int
+		newBlock func(key []byte) (cipher.Block, error)
+	}{
+		"2.16.840.1.101.3.4.1.2":  {16, aes.NewCipher},
+		"2.16.840.1.101.3.4.1.22": {24, aes.NewCipher},
+		"2.16.840.1.101.3.4.1.42": {32, aes.NewCipher},
+		"1.2.840.113549.3.7":      {24, des.NewTripleDESCipher},
+	}
+)
+
+type encryptedPrivateKeyInfo struct {
+	Algorithm     pkix.AlgorithmIdentifier
+	EncryptedData []byte
+}
+
+type pbes2Params struct {
+	KeyDerivationFunc pkix.AlgorithmIdentifier
+	EncryptionScheme  pkix.AlgorithmIdentifier
+}
+
+type pbkdf2Params struct {
+	Salt           []byte
+	IterationCount int
+	KeyLength      int                      `asn1:"optional"`
+	PRF            pkix.AlgorithmIdentifier `asn1:"optional"`
+}
+
+// encryptedPKCS8Block return the PEM block of an encrypted PKCS#8 key, nil for other content
+func encryptedPKCS8Block(content []byte) *pem.Block {
+	block, _ := pem.Decode(content)
+	if block == nil || block.Type != pkcs8EncryptedBlock {
+		return nil
+	}
+
+	return block
+}
+
+// parseEncryptedPKCS8 decrypt a PBES2 encrypted PKCS#8 key.
+// Without passphrase *ssh.PassphraseMissingError is returned, the public key is not stored in this format.
+func parseEncryptedPKCS8(block *pem.Block, passphrase []byte) (any, error) {
+	if passphrase == nil {
+		return nil, &ssh.PassphraseMissingError{}
+	}
+
+	var info encryptedPrivateKeyInfo
+	if _, err := asn1.Unmarshal(block.Bytes, &info); err != nil {
+		return nil, fmt.Errorf("failed to parse encrypted pkcs8 key: %w", err)
+	}
+
+	if !info.Algorithm.Algorithm.Equal(oidPBES2) {
+		return nil, fmt.Errorf("unsupported pkcs8 encryption %s, only PBES2 is supported", info.Algorithm.Algorithm)
+	}
+
+	var params pbes2Params
+	if _, err := asn1.Unmarshal(info.Algorithm.Parameters.FullBytes, &params); err != nil {
+		return nil, fmt.Errorf("failed to parse pbes2 parameters: %w", err)
+	}
+
+	if !params.KeyDerivationFunc.Algorithm.Equal(oidPBKDF2) {
+		return nil, fmt.Errorf("unsupported pbes2 key derivation %s", params.KeyDerivationFunc.Algorithm)
+	}
+
+	var kdf pbkdf2Params
+	if _, err := asn1.Unmarshal(params.KeyDerivationFunc.Parameters.FullBytes, &kdf); err != nil {
+		return nil, fmt.Errorf("failed to parse pbkdf2 parameters: %w", err)
+	}
+
+	if kdf.IterationCount < 1 || kdf.IterationCount > pkcs8MaxIterations {
+		return nil, fmt.Errorf("pbkdf2 iteration count %d out of range", kdf.IterationCount)
+	}
+
+	prf := sha1.New
+	if len(kdf.PRF.Algorithm) > 0 {
+		var ok bool
+		if prf, ok = pbkdf2PRFs[kdf.PRF.Algorithm.String()]; !ok {
+			return nil, fmt.Errorf("unsupported pbkdf2 prf %s", kdf.PRF.Algorithm)
+		}
+	}
+
+	scheme, ok := pbes2Ciphers[params.EncryptionScheme.Algorithm.String()]
+	if !ok {
+		return nil, fmt.Errorf("unsupported pbes2 cipher %s", params.EncryptionScheme.Algorithm)
+	}
+
+	var iv []byte
+	if _, err := asn1.Unmarshal(params.EncryptionScheme.Parameters.FullBytes, &iv); err != nil {
+		return nil, fmt.Errorf("failed to parse pbes2 iv: %w", err)
+	}
+
+	key, err := pbkdf2.Key(prf, string(passphrase), kdf.Salt, kdf.IterationCount, scheme.keyLen)
+	if err != nil {
+		return nil, fmt.Errorf("failed to derive pkcs8 key: %w", err)
+	}
+
+	c, err := scheme.newBlock(key)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(iv) != c.BlockSize() || len(info.EncryptedData) == 0 || len(info.EncryptedData)%c.BlockSize() != 0 {
+		return nil, errors.New("invalid encrypted pkcs8 data")
+	}
+
+	plain := make([]byte, len(info.EncryptedData))
+	cipher.NewCBCDecrypter(c, iv).CryptBlocks(plain, info.EncryptedData)
+
+	// a wrong passphrase show up as bad padding or garbage DER
+	padding := int(plain[len(plain)-1])
+	if padding == 0 || padding > c.BlockSize() {
+		return nil, x509.IncorrectPasswordError
+	}
+	for _, b := range plain[len(plain)-padding:] {
+		if int(b) != padding {
+			return nil, x509.IncorrectPasswordError
+		}
+	}
+
+	privateKey, err := x509.ParsePKCS8PrivateKey(plain[:len(plain)-padding])
+	if err != nil {
+		return nil, x509.IncorrectPasswordError
+	}
+
+	return privateKey, nil
+}
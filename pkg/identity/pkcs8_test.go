@@ -0,0 +1,145 @@
+package identity
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/pbkdf2"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"testing"
+
+	"golang.org/x/crypto/ssh"
+)
+
+var (
+	oidHMACWithSHA256 = asn1.ObjectIdentifier{1, 2, 840, 113549, 2, 9}
+	oidAES256CBC      = asn1.ObjectIdentifier{2, 16, 840, 1, 101, 3, 4, 1, 42}
+)
+
+// encodeEncryptedPKCS8 encrypt the key with PBES2, PBKDF2-HMAC-SHA256 and AES-256-CBC, like openssl pkcs8 -topk8
+func encodeEncryptedPKCS8(t *testing.T, key any, passphrase string, iterations int) []byte {
+	t.Helper()
+
+	der, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	salt, iv := make([]byte, 16), make([]byte, aes.BlockSize)
+	if _, err = rand.Read(salt); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = rand.Read(iv); err != nil {
+		t.Fatal(err)
+	}
+
+	// the cipher key is derived with at most 1000 iterations, the parser must reject larger counts before deriving
+	derived, err := pbkdf2.Key(sha256.New, passphrase, salt, min(iterations, 1000), 32)
+	if err != nil {
+		t.Fatal(err)
+	}
+	block, err := aes.NewCipher(derived)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	padding := aes.BlockSize - len(der)%aes.BlockSize
+	encrypted := append(der, bytes.Repeat([]byte{byte(padding)}, padding)...)
+	cipher.NewCBCEncrypter(block, iv).CryptBlocks(encrypted, encrypted)
+
+	marshal := func(v any) asn1.RawValue {
+		b, err := asn1.Marshal(v)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return asn1.RawValue{FullBytes: b}
+	}
+
+	info := encryptedPrivateKeyInfo{
+		Algorithm: pkix.AlgorithmIdentifier{
+			Algorithm: oidPBES2,
+			Parameters: marshal(pbes2Params{
+				KeyDerivationFunc: pkix.AlgorithmIdentifier{
+					Algorithm: oidPBKDF2,
+					Parameters: marshal(pbkdf2Params{
+						Salt:           salt,
+						IterationCount: iterations,
+						PRF:            pkix.AlgorithmIdentifier{Algorithm: oidHMACWithSHA256, Parameters: asn1.NullRawValue},
+					}),
+				},
+				EncryptionScheme: pkix.AlgorithmIdentifier{Algorithm: oidAES256CBC, Parameters: marshal(iv)},
+			}),
+		},
+		EncryptedData: encrypted,
+	}
+
+	content, err := asn1.Marshal(info)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return pem.EncodeToMemory(&pem.Block{Type: pkcs8EncryptedBlock, Bytes: content})
+}
+
+func TestParseEncryptedPKCS8(t *testing.T) {
+	_, edKey, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ecKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, key := range []any{edKey, rsaKey, ecKey} {
+		t.Run(fmt.Sprintf("%T", key), func(t *testing.T) {
+			content := encodeEncryptedPKCS8(t, key, "secret", 1000)
+
+			var missing *ssh.PassphraseMissingError
+			if _, err := ParseRawPrivateKey(content); !errors.As(err, &missing) {
+				t.Fatalf("encrypted pkcs8 without passphrase: got %v, want PassphraseMissingError", err)
+			}
+
+			if _, err := ParseRawPrivateKeyWithPassphrase(content, []byte("wrong")); !errors.Is(err, x509.IncorrectPasswordError) {
+				t.Fatalf("encrypted pkcs8 with wrong passphrase: got %v, want IncorrectPasswordError", err)
+			}
+
+			parsed, err := ParseRawPrivateKeyWithPassphrase(content, []byte("secret"))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !samePublicKey(t, parsed, key) {
+				t.Fatal("encrypted pkcs8 parsed into another key")
+			}
+		})
+	}
+}
+
+func TestParseEncryptedPKCS8IterationLimit(t *testing.T) {
+	_, key, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, iterations := range []int{0, pkcs8MaxIterations + 1} {
+		content := encodeEncryptedPKCS8(t, key, "secret", iterations)
+		if _, err = ParseRawPrivateKeyWithPassphrase(content, []byte("secret")); err == nil || errors.Is(err, x509.IncorrectPasswordError) {
+			t.Errorf("%d pbkdf2 iterations: got %v, want an out of range error", iterations, err)
+		}
+	}
+}
@@ -0,0 +1,388 @@
+package identity
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/dsa"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/hmac"
+	"crypto/rsa"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"hash"
+	"math/big"
+	"strconv"
+	"strings"
+
+	"golang.org/x/crypto/argon2"
+	"golang.org/x/crypto/ssh"
+)
+
+// ppkMagic the first line prefix of a PuTTY private key file
+const ppkMagic = "PuTTY-User-Key-File-"
+
+const (
+	// ppkMaxArgon2Memory the Argon2 memory accepted from a key file, in KiB. PuTTY use 8 MiB by default.
+	ppkMaxArgon2Memory = 256 * 1024
+	// ppkMaxArgon2Work the Argon2 memory times passes accepted from a key file, bounding the decryption time
+	ppkMaxArgon2Work = 1 << 22
+)
+
+// ppkKey a parsed PuTTY private key file, version 2 or 3
+type ppkKey struct {
+	version    int
+	algorithm  string
+	encryption string
+	comment    string
+	public     []byte
+	private    []byte
+	mac        []byte
+	// headers the remaining headers, the Argon2 parameters of version 3
+	headers map[string]string
+}
+
+func isPPK(content []byte) bool {
+	return bytes.HasPrefix(content, []byte(ppkMagic))
+}
+
+// parsePPK parse the PuTTY key file, decrypting it with the passphrase when it is encrypted.
+// An encrypted key without passphrase return *ssh.PassphraseMissingError with the public key.
+func parsePPK(content []byte, passphrase []byte) (any, error) {
+	k, err := readPPK(content)
+	if err != nil {
+		return nil, err
+	}
+
+	if k.encryption != "none" && passphrase == nil {
+		pub, err := ssh.ParsePublicKey(k.public)
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse ppk public key: %w", err)
+		}
+		return nil, &ssh.PassphraseMissingError{PublicKey: pub}
+	}
+
+	private, err := k.decrypt(passphrase)
+	if err != nil {
+		return nil, err
+	}
+
+	return ppkPrivateKey(k.algorithm, k.public, private)
+}
+
+func readPPK(content []byte) (*ppkKey, error) {
+	k := &ppkKey{headers: make(map[string]string)}
+
+	scanner := bufio.NewScanner(bytes.NewReader(content))
+	for scanner.Scan() {
+		line := strings.TrimRight(scanner.Text(), "\r")
+		if line == "" {
+			continue
+		}
+
+		name, value, ok := strings.Cut(line, ": ")
+		if !ok {
+			return nil, fmt.Errorf("invalid ppk line %q", line)
+		}
+
+		switch {
+		case strings.HasPrefix(name, ppkMagic):
+			version, err := strconv.Atoi(strings.TrimPrefix(name, ppkMagic))
+			if err != nil || (version != 2 && version != 3) {
+				return nil, fmt.Errorf("unsupported ppk version %q", name)
+			}
+			k.version = version
+			k.algorithm = value
+		case name == "Encryption":
+			k.encryption = value
+		case name == "Comment":
+			k.comment = value
+		case name == "Public-Lines", name == "Private-Lines":
+			blob, err := readPPKLines(scanner, value)
+			if err != nil {
+				return nil, err
+			}
+			if name == "Public-Lines" {
+				k.public = blob
+			} else {
+				k.private = blob
+			}
+		case name == "Private-MAC":
+			mac, err := hex.DecodeString(value)
+			if err != nil {
+				return nil, fmt.Errorf("invalid ppk mac: %w", err)
+			}
+			k.mac = mac
+		default:
+			k.headers[name] = value
+		}
+	}
+
+	if k.version == 0 || k.public == nil || k.private == nil || k.mac == nil {
+		return nil, errors.New("incomplete ppk file")
+	}
+
+	if k.encryption != "none" && k.encryption != "aes256-cbc" {
+		return nil, fmt.Errorf("unsupported ppk encryption %q", k.encryption)
+	}
+
+	return k, nil
+}
+
+func readPPKLines(scanner *bufio.Scanner, count string) ([]byte, error) {
+	n, err := strconv.Atoi(count)
+	if err != nil || n < 0 {
+		return nil, fmt.Errorf("invalid ppk line count %q", count)
+	}
+
+	var encoded strings.Builder
+	for i := 0; i < n; i++ {
+		if !scanner.Scan() {
+			return nil, errors.New("truncated ppk file")
+		}
+		encoded.WriteString(strings.TrimSpace(scanner.Text()))
+	}
+
+	return base64.StdEncoding.DecodeString(encoded.String())
+}
+
+// decrypt return the private blob, after checking the MAC.
+// A MAC mismatch of an encrypted key means the passphrase is wrong.
+func (k *ppkKey) decrypt(passphrase []byte) ([]byte, error) {
+	var cipherKey, iv, macKey []byte
+	var newHash func() hash.Hash
+
+	switch k.version {
+	case 2:
+		newHash = sha1.New
+		macKey = ppkV2MACKey(passphrase)
+		if k.encryption != "none" {
+			cipherKey = ppkV2CipherKey(passphrase)
+			iv = make([]byte, aes.BlockSize)
+		}
+	case 3:
+		newHash = sha256.New
+		macKey = []byte{}
+		if k.encryption != "none" {
+			derived, err := k.argon2(passphrase)
+			if err != nil {
+				return nil, err
+			}
+			cipherKey, iv, macKey = derived[:32], derived[32:48], derived[48:]
+		}
+	}
+
+	private := k.private
+	if cipherKey != nil {
+		if len(private)%aes.BlockSize != 0 {
+			return nil, errors.New("invalid ppk private blob length")
+		}
+
+		block, err := aes.NewCipher(cipherKey)
+		if err != nil {
+			return nil, err
+		}
+
+		private = make([]byte, len(k.private))
+		cipher.NewCBCDecrypter(block, iv).CryptBlocks(private, k.private)
+	}
+
+	mac := hmac.New(newHash, macKey)
+	for _, field := range [][]byte{[]byte(k.algorithm), []byte(k.encryption), []byte(k.comment), k.public, private} {
+		_ = binary.Write(mac, binary.BigEndian, uint32(len(field)))
+		mac.Write(field)
+	}
+
+	if !hmac.Equal(mac.Sum(nil), k.mac) {
+		if cipherKey != nil {
+			return nil, x509.IncorrectPasswordError
+		}
+		return nil, errors.New("ppk mac mismatch, the file is corrupted")
+	}
+
+	return private, nil
+}
+
+func ppkV2CipherKey(passphrase []byte) []byte {
+	key := make([]byte, 0, 2*sha1.Size)
+	for i := uint32(0); i < 2; i++ {
+		h := sha1.New()
+		_ = binary.Write(h, binary.BigEndian, i)
+		h.Write(passphrase)
+		key = h.Sum(key)
+	}
+
+	return key[:32]
+}
+
+func ppkV2MACKey(passphrase []byte) []byte {
+	h := sha1.New()
+	h.Write([]byte("putty-private-key-file-mac-key"))
+	h.Write(passphrase)
+
+	return h.Sum(nil)
+}
+
+// argon2 derive the cipher key, IV and MAC key of a version 3 key
+func (k *ppkKey) argon2(passphrase []byte) ([]byte, error) {
+	var params [3]uint32
+	for i, name := range []string{"Argon2-Memory", "Argon2-Passes", "Argon2-Parallelism"} {
+		v, err := strconv.ParseUint(k.headers[name], 10, 32)
+		if err != nil {
+			return nil, fmt.Errorf("invalid ppk %s: %w", name, err)
+		}
+		params[i] = uint32(v)
+	}
+	memory, passes, parallelism := params[0], params[1], params[2]
+	if parallelism == 0 || parallelism > 255 {
+		return nil, fmt.Errorf("invalid ppk Argon2-Parallelism %d", parallelism)
+	}
+	if memory > ppkMaxArgon2Memory {
+		return nil, fmt.Errorf("ppk Argon2-Memory %d KiB exceeds the limit of %d KiB", memory, ppkMaxArgon2Memory)
+	}
+	if passes == 0 || uint64(memory)*uint64(passes) > ppkMaxArgon2Work {
+		return nil, fmt.Errorf("ppk Argon2-Passes %d out of range for Argon2-Memory %d KiB", passes, memory)
+	}
+
+	salt, err := hex.DecodeString(k.headers["Argon2-Salt"])
+	if err != nil {
+		return nil, fmt.Errorf("invalid ppk Argon2-Salt: %w", err)
+	}
+
+	const keyLen = 32 + aes.BlockSize + 32
+	switch k.headers["Key-Derivation"] {
+	case "Argon2id":
+		return argon2.IDKey(passphrase, salt, passes, memory, uint8(parallelism), keyLen), nil
+	case "Argon2i":
+		return argon2.Key(passphrase, salt, passes, memory, uint8(parallelism), keyLen), nil
+	default:
+		return nil, fmt.Errorf("unsupported ppk key derivation %q", k.headers["Key-Derivation"])
+	}
+}
+
+// ppkPrivateKey build the private key from the public and private blobs
+func ppkPrivateKey(algorithm string, public, private []byte) (any, error) {
+	pub := &wireReader{buf: public}
+	priv := &wireReader{buf: private}
+
+	if name := pub.string(); name != algorithm {
+		return nil, fmt.Errorf("ppk public key type %q does not match %q", name, algorithm)
+	}
+
+	var key any
+	switch algorithm {
+	case ssh.KeyAlgoRSA:
+		e, n := pub.mpint(), pub.mpint()
+		d, p, q, _ := priv.mpint(), priv.mpint(), priv.mpint(), priv.mpint()
+		if pub.err == nil && priv.err == nil {
+			if !e.IsInt64() {
+				return nil, errors.New("invalid ppk rsa exponent")
+			}
+			rsaKey := &rsa.PrivateKey{
+				PublicKey: rsa.PublicKey{N: n, E: int(e.Int64())},
+				D:         d,
+				Primes:    []*big.Int{p, q},
+			}
+			if err := rsaKey.Validate(); err != nil {
+				return nil, fmt.Errorf("invalid ppk rsa key: %w", err)
+			}
+			rsaKey.Precompute()
+			key = rsaKey
+		}
+	case ssh.KeyAlgoDSA:
+		p, q, g, y := pub.mpint(), pub.mpint(), pub.mpint(), pub.mpint()
+		x := priv.mpint()
+		key = &dsa.PrivateKey{
+			PublicKey: dsa.PublicKey{Parameters: dsa.Parameters{P: p, Q: q, G: g}, Y: y},
+			X:         x,
+		}
+	case ssh.KeyAlgoECDSA256, ssh.KeyAlgoECDSA384, ssh.KeyAlgoECDSA521:
+		curve := map[string]elliptic.Curve{
+			ssh.KeyAlgoECDSA256: elliptic.P256(),
+			ssh.KeyAlgoECDSA384: elliptic.P384(),
+			ssh.KeyAlgoECDSA521: elliptic.P521(),
+		}[algorithm]
+		_ = pub.string()
+		point := pub.bytes()
+		d := priv.mpint()
+		if pub.err == nil && priv.err == nil {
+			x, y := elliptic.Unmarshal(curve, point)
+			if x == nil {
+				return nil, errors.New("invalid ppk ecdsa public key")
+			}
+			ecKey := &ecdsa.PrivateKey{PublicKey: ecdsa.PublicKey{Curve: curve, X: x, Y: y}, D: d}
+			if cx, cy := curve.ScalarBaseMult(d.Bytes()); cx.Cmp(x) != 0 || cy.Cmp(y) != 0 {
+				return nil, errors.New("ppk ecdsa private key does not match public key")
+			}
+			key = ecKey
+		}
+	case ssh.KeyAlgoED25519:
+		public := pub.bytes()
+		seed := priv.bytes()
+		if pub.err == nil && priv.err == nil {
+			// PuTTY write the seed as a minimal little-endian integer, dropping the trailing zero bytes
+			if len(seed) > ed25519.SeedSize {
+				return nil, errors.New("invalid ppk ed25519 private key")
+			}
+			padded := make([]byte, ed25519.SeedSize)
+			copy(padded, seed)
+			edKey := ed25519.NewKeyFromSeed(padded)
+			if !bytes.Equal(edKey.Public().(ed25519.PublicKey), public) {
+				return nil, errors.New("ppk ed25519 private key does not match public key")
+			}
+			key = &edKey
+		}
+	default:
+		return nil, fmt.Errorf("unsupported key type %q in ppk file", algorithm)
+	}
+
+	if pub.err != nil || priv.err != nil {
+		return nil, fmt.Errorf("invalid ppk %s key: %w", algorithm, errors.Join(pub.err, priv.err))
+	}
+
+	return key, nil
+}
+
+// wireReader read SSH wire format fields, remembering the first error
+type wireReader struct {
+	buf []byte
+	err error
+}
+
+func (r *wireReader) bytes() []byte {
+	if r.err != nil {
+		return nil
+	}
+
+	if len(r.buf) < 4 {
+		r.err = errors.New("truncated key blob")
+		return nil
+	}
+
+	n := binary.BigEndian.Uint32(r.buf)
+	if uint64(len(r.buf)-4) < uint64(n) {
+		r.err = errors.New("truncated key blob")
+		return nil
+	}
+
+	b := r.buf[4 : 4+n]
+	r.buf = r.buf[4+n:]
+	return b
+}
+
+func (r *wireReader) string() string {
+	return string(r.bytes())
+}
+
+func (r *wireReader) mpint() *big.Int {
+	return new(big.Int).SetBytes(r.bytes())
+}
@@ -0,0 +1,288 @@
+package identity
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"math/big"
+	"strconv"
+	"strings"
+	"testing"
+
+	"golang.org/x/crypto/argon2"
+	"golang.org/x/crypto/ssh"
+)
+
+// ppkArgon2 the Argon2 parameters of the version 3 test files, much cheaper than the PuTTY defaults
+var ppkArgon2 = map[string]string{
+	"Key-Derivation":     "Argon2id",
+	"Argon2-Memory":      "64",
+	"Argon2-Passes":      "1",
+	"Argon2-Parallelism": "1",
+	"Argon2-Salt":        "000102030405060708090a0b0c0d0e0f",
+}
+
+// ppkPrivateBlob encode the private part of the key like PuTTY
+func ppkPrivateBlob(t *testing.T, key any) []byte {
+	t.Helper()
+
+	var blob []byte
+	putBytes := func(b []byte) {
+		blob = binary.BigEndian.AppendUint32(blob, uint32(len(b)))
+		blob = append(blob, b...)
+	}
+	putMPInt := func(n *big.Int) {
+		b := n.Bytes()
+		if len(b) > 0 && b[0]&0x80 != 0 {
+			b = append([]byte{0}, b...)
+		}
+		putBytes(b)
+	}
+
+	switch key := key.(type) {
+	case ed25519.PrivateKey:
+		// a minimal little-endian integer, see put_mp_le_unsigned
+		putBytes(bytes.TrimRight(key.Seed(), "\x00"))
+	case *rsa.PrivateKey:
+		putMPInt(key.D)
+		putMPInt(key.Primes[0])
+		putMPInt(key.Primes[1])
+		putMPInt(key.Precomputed.Qinv)
+	case *ecdsa.PrivateKey:
+		putMPInt(key.D)
+	default:
+		t.Fatalf("unsupported test key %T", key)
+	}
+
+	return blob
+}
+
+// encodePPK build a PuTTY key file, encrypted when passphrase is not empty
+func encodePPK(t *testing.T, version int, key any, passphrase string, headers map[string]string) []byte {
+	t.Helper()
+
+	signer, err := ssh.NewSignerFromKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	algorithm, public := signer.PublicKey().Type(), signer.PublicKey().Marshal()
+	private := ppkPrivateBlob(t, key)
+
+	encryption, comment := "none", "ppk test key"
+	var cipherKey, iv, macKey []byte
+	newHash := sha1.New
+	// the keys are derived as described by the PuTTY documentation, appendix C, not with the parser helpers
+	switch version {
+	case 2:
+		mac := sha1.Sum([]byte("putty-private-key-file-mac-key" + passphrase))
+		macKey = mac[:]
+		if passphrase != "" {
+			h0 := sha1.Sum(append([]byte{0, 0, 0, 0}, passphrase...))
+			h1 := sha1.Sum(append([]byte{0, 0, 0, 1}, passphrase...))
+			cipherKey, iv = append(h0[:], h1[:32-sha1.Size]...), make([]byte, aes.BlockSize)
+		}
+	case 3:
+		newHash = sha256.New
+		macKey = []byte{}
+		if passphrase != "" {
+			var params [3]uint32
+			for i, name := range []string{"Argon2-Memory", "Argon2-Passes", "Argon2-Parallelism"} {
+				v, err := strconv.ParseUint(headers[name], 10, 32)
+				if err != nil {
+					t.Fatal(err)
+				}
+				params[i] = uint32(v)
+			}
+			salt, err := hex.DecodeString(headers["Argon2-Salt"])
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			derived := argon2.IDKey([]byte(passphrase), salt, params[1], params[0], uint8(params[2]), 80)
+			cipherKey, iv, macKey = derived[:32], derived[32:48], derived[48:]
+		}
+	}
+
+	if passphrase != "" {
+		encryption = "aes256-cbc"
+		if pad := len(private) % aes.BlockSize; pad != 0 {
+			private = append(private, make([]byte, aes.BlockSize-pad)...)
+		}
+	}
+
+	mac := hmac.New(newHash, macKey)
+	for _, field := range [][]byte{[]byte(algorithm), []byte(encryption), []byte(comment), public, private} {
+		_ = binary.Write(mac, binary.BigEndian, uint32(len(field)))
+		mac.Write(field)
+	}
+
+	if cipherKey != nil {
+		block, err := aes.NewCipher(cipherKey)
+		if err != nil {
+			t.Fatal(err)
+		}
+		cipher.NewCBCEncrypter(block, iv).CryptBlocks(private, private)
+	}
+
+	var b strings.Builder
+	fmt.Fprintf(&b, "PuTTY-User-Key-File-%d: %s\r\nEncryption: %s\r\nComment: %s\r\n", version, algorithm, encryption, comment)
+	writePPKLines(&b, "Public-Lines", public)
+	if version == 3 && passphrase != "" {
+		for _, name := range []string{"Key-Derivation", "Argon2-Memory", "Argon2-Passes", "Argon2-Parallelism", "Argon2-Salt"} {
+			fmt.Fprintf(&b, "%s: %s\r\n", name, headers[name])
+		}
+	}
+	writePPKLines(&b, "Private-Lines", private)
+	fmt.Fprintf(&b, "Private-MAC: %s\r\n", hex.EncodeToString(mac.Sum(nil)))
+
+	return []byte(b.String())
+}
+
+func writePPKLines(b *strings.Builder, name string, blob []byte) {
+	encoded := base64.StdEncoding.EncodeToString(blob)
+
+	var lines []string
+	for len(encoded) > 64 {
+		lines = append(lines, encoded[:64])
+		encoded = encoded[64:]
+	}
+	lines = append(lines, encoded)
+
+	fmt.Fprintf(b, "%s: %d\r\n%s\r\n", name, len(lines), strings.Join(lines, "\r\n"))
+}
+
+func samePublicKey(t *testing.T, a, b any) bool {
+	t.Helper()
+
+	sa, err := ssh.NewSignerFromKey(a)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sb, err := ssh.NewSignerFromKey(b)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return bytes.Equal(sa.PublicKey().Marshal(), sb.PublicKey().Marshal())
+}
+
+func TestParsePPK(t *testing.T) {
+	_, edKey, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ecKey, err := ecdsa.GenerateKey(elliptic.P384(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for name, key := range map[string]any{"ed25519": edKey, "rsa": rsaKey, "ecdsa": ecKey} {
+		for _, version := range []int{2, 3} {
+			t.Run(fmt.Sprintf("%s/v%d", name, version), func(t *testing.T) {
+				plain := encodePPK(t, version, key, "", nil)
+				parsed, err := ParseRawPrivateKey(plain)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if !samePublicKey(t, parsed, key) {
+					t.Fatal("unencrypted ppk parsed into another key")
+				}
+
+				encrypted := encodePPK(t, version, key, "secret", ppkArgon2)
+
+				var missing *ssh.PassphraseMissingError
+				if _, err = ParseRawPrivateKey(encrypted); !errors.As(err, &missing) || missing.PublicKey == nil {
+					t.Fatalf("encrypted ppk without passphrase: got %v, want PassphraseMissingError with public key", err)
+				}
+
+				if _, err = ParseRawPrivateKeyWithPassphrase(encrypted, []byte("wrong")); !errors.Is(err, x509.IncorrectPasswordError) {
+					t.Fatalf("encrypted ppk with wrong passphrase: got %v, want IncorrectPasswordError", err)
+				}
+
+				parsed, err = ParseRawPrivateKeyWithPassphrase(encrypted, []byte("secret"))
+				if err != nil {
+					t.Fatal(err)
+				}
+				if !samePublicKey(t, parsed, key) {
+					t.Fatal("encrypted ppk parsed into another key")
+				}
+			})
+		}
+	}
+}
+
+func TestParsePPKShortEd25519Seed(t *testing.T) {
+	// PuTTY drop the trailing zero bytes of the seed, about 1 in 256 keys
+	seed := make([]byte, ed25519.SeedSize)
+	if _, err := rand.Read(seed); err != nil {
+		t.Fatal(err)
+	}
+	seed[ed25519.SeedSize-1] = 0
+	key := ed25519.NewKeyFromSeed(seed)
+
+	content := encodePPK(t, 2, key, "", nil)
+	parsed, err := ParseRawPrivateKey(content)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	edKey, ok := parsed.(*ed25519.PrivateKey)
+	if !ok || !bytes.Equal(edKey.Seed(), seed) {
+		t.Fatalf("parsed %T, want the ed25519 key of the seed", parsed)
+	}
+}
+
+func TestParsePPKCorrupted(t *testing.T) {
+	_, key, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	content := encodePPK(t, 3, key, "", nil)
+	content = bytes.Replace(content, []byte("Comment: ppk test key"), []byte("Comment: tampered key"), 1)
+
+	if _, err = ParseRawPrivateKey(content); err == nil || errors.Is(err, x509.IncorrectPasswordError) {
+		t.Fatalf("tampered ppk: got %v, want a mac mismatch", err)
+	}
+}
+
+func TestPPKArgon2Limits(t *testing.T) {
+	tests := map[string]map[string]string{
+		"memory":      {"Argon2-Memory": fmt.Sprint(ppkMaxArgon2Memory + 1), "Argon2-Passes": "1"},
+		"zero passes": {"Argon2-Memory": "64", "Argon2-Passes": "0"},
+		"work":        {"Argon2-Memory": fmt.Sprint(ppkMaxArgon2Memory), "Argon2-Passes": "1000"},
+	}
+
+	for name, override := range tests {
+		headers := make(map[string]string, len(ppkArgon2))
+		for k, v := range ppkArgon2 {
+			headers[k] = v
+		}
+		for k, v := range override {
+			headers[k] = v
+		}
+
+		k := &ppkKey{headers: headers}
+		if _, err := k.argon2([]byte("secret")); err == nil {
+			t.Errorf("%s: crafted Argon2 parameters were accepted", name)
+		}
+	}
+}
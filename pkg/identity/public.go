@@ -0,0 +1,42 @@
+package identity
+
+import (
+	"errors"
+	"fmt"
+	"os"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// ErrNoPublicKey the public key can not be read without decrypting the private key
+var ErrNoPublicKey = errors.New("public key unavailable")
+
+// PublicKey return the public key and comment of a private key file without decrypting it,
+// read from the adjacent .pub file or the unencrypted header of the OpenSSH key format.
+func PublicKey(file string, content []byte) (ssh.PublicKey, string, error) {
+	if pub, comment, err := readPublicKeyFile(file + ".pub"); err == nil {
+		return pub, comment, nil
+	}
+
+	_, err := ParseRawPrivateKey(content)
+	var missing *ssh.PassphraseMissingError
+	if !errors.As(err, &missing) || missing.PublicKey == nil {
+		return nil, "", ErrNoPublicKey
+	}
+
+	return missing.PublicKey, "", nil
+}
+
+func readPublicKeyFile(file string) (ssh.PublicKey, string, error) {
+	content, err := os.ReadFile(file)
+	if err != nil {
+		return nil, "", err
+	}
+
+	pub, comment, _, _, err := ssh.ParseAuthorizedKey(content)
+	if err != nil {
+		return nil, "", fmt.Errorf("failed to parse public key file %q: %w", file, err)
+	}
+
+	return pub, comment, nil
+}
@@ -0,0 +1,260 @@
+package identity
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"os/user"
+	"path/filepath"
+	"strings"
+)
+
+// maxIncludeDepth the Include nesting limit, the same as OpenSSH
+const maxIncludeDepth = 16
+
+// SSHConfig the identity related entries of an ssh_config file, collected across all Host and Match blocks
+type SSHConfig struct {
+	// IdentityFiles the expanded IdentityFile paths, in file order
+	IdentityFiles []string
+	// CertificateFiles the expanded CertificateFile paths, in file order
+	CertificateFiles []string
+	// ControlDirs the directories holding the ControlPath sockets
+	ControlDirs []string
+}
+
+// UserSSHConfigPath return the path of ~/.ssh/config
+func UserSSHConfigPath() (string, error) {
+	homeDir, err := os.UserHomeDir()
+	if err != nil {
+		return "", err
+	}
+
+	return filepath.Join(homeDir, ".ssh", "config"), nil
+}
+
+// ParseSSHConfig parse the ssh_config file and the files it includes.
+// Paths are expanded for ~, %d, %u, %i, %l, %% and ${ENV}, paths with host dependent tokens such as %h are skipped.
+func ParseSSHConfig(path string) (*SSHConfig, error) {
+	p, err := newConfigParser()
+	if err != nil {
+		return nil, err
+	}
+
+	if err = p.parseFile(path, 0); err != nil {
+		return nil, err
+	}
+
+	return &p.config, nil
+}
+
+type configParser struct {
+	config  SSHConfig
+	homeDir string
+	tokens  map[byte]string
+	seen    map[string]struct{}
+}
+
+func newConfigParser() (*configParser, error) {
+	homeDir, err := os.UserHomeDir()
+	if err != nil {
+		return nil, err
+	}
+
+	p := &configParser{
+		homeDir: homeDir,
+		tokens: map[byte]string{
+			'd': homeDir,
+			'i': fmt.Sprint(os.Getuid()),
+			'%': "%",
+		},
+		seen: make(map[string]struct{}),
+	}
+
+	if u, err := user.Current(); err == nil {
+		p.tokens['u'] = u.Username
+	}
+
+	if hostname, err := os.Hostname(); err == nil {
+		p.tokens['l'] = hostname
+	}
+
+	return p, nil
+}
+
+func (p *configParser) parseFile(path string, depth int) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return fmt.Errorf("failed to open ssh config %q: %w", path, err)
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		keyword, args := splitConfigLine(scanner.Text())
+		if len(args) == 0 {
+			continue
+		}
+
+		switch strings.ToLower(keyword) {
+		case "identityfile":
+			if path, ok := p.expand(args[0]); ok && path != "none" {
+				p.config.IdentityFiles = appendPath(p.config.IdentityFiles, path)
+			}
+		case "certificatefile":
+			if path, ok := p.expand(args[0]); ok && path != "none" {
+				p.config.CertificateFiles = appendPath(p.config.CertificateFiles, path)
+			}
+		case "controlpath":
+			if args[0] == "none" {
+				continue
+			}
+			if dir, ok := p.expand(filepath.Dir(args[0])); ok {
+				p.config.ControlDirs = appendPath(p.config.ControlDirs, dir)
+			}
+		case "include":
+			if depth >= maxIncludeDepth {
+				return fmt.Errorf("ssh config %q: include nested too deep", path)
+			}
+
+			for _, pattern := range args {
+				if err = p.include(pattern, depth+1); err != nil {
+					return err
+				}
+			}
+		}
+	}
+
+	if err = scanner.Err(); err != nil {
+		return fmt.Errorf("failed to read ssh config %q: %w", path, err)
+	}
+
+	return nil
+}
+
+// include parse the files matching the Include pattern, relative patterns are resolved in ~/.ssh
+func (p *configParser) include(pattern string, depth int) error {
+	pattern, ok := p.expand(pattern)
+	if !ok {
+		return nil
+	}
+
+	if !filepath.IsAbs(pattern) {
+		pattern = filepath.Join(p.homeDir, ".ssh", pattern)
+	}
+
+	matches, err := filepath.Glob(pattern)
+	if err != nil {
+		return fmt.Errorf("bad include pattern %q: %w", pattern, err)
+	}
+
+	for _, match := range matches {
+		if _, ok := p.seen[match]; ok {
+			continue
+		}
+		p.seen[match] = struct{}{}
+
+		if fi, err := os.Stat(match); err != nil || !fi.Mode().IsRegular() {
+			continue
+		}
+
+		if err = p.parseFile(match, depth); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// expand expand ~, % tokens and ${ENV} in the path, and report false when it depends on the host
+func (p *configParser) expand(path string) (string, bool) {
+	if path == "~" {
+		path = p.homeDir
+	} else if strings.HasPrefix(path, "~/") {
+		path = filepath.Join(p.homeDir, path[2:])
+	}
+
+	var b strings.Builder
+	for i := 0; i < len(path); i++ {
+		switch {
+		case path[i] == '%' && i+1 < len(path):
+			value, ok := p.tokens[path[i+1]]
+			if !ok {
+				return "", false
+			}
+			b.WriteString(value)
+			i++
+		case path[i] == '%':
+			return "", false
+		case strings.HasPrefix(path[i:], "${"):
+			end := strings.IndexByte(path[i:], '}')
+			if end < 0 {
+				return "", false
+			}
+			value, ok := os.LookupEnv(path[i+2 : i+end])
+			if !ok {
+				return "", false
+			}
+			b.WriteString(value)
+			i += end
+		default:
+			b.WriteByte(path[i])
+		}
+	}
+
+	return b.String(), true
+}
+
+// splitConfigLine split a config line into keyword and arguments, honoring double quotes and the keyword=value form
+func splitConfigLine(line string) (string, []string) {
+	line = strings.TrimSpace(line)
+	if line == "" || line[0] == '#' {
+		return "", nil
+	}
+
+	end := strings.IndexAny(line, " \t=")
+	if end < 0 {
+		return line, nil
+	}
+	keyword := line[:end]
+
+	rest := strings.TrimLeft(line[end:], " \t")
+	rest = strings.TrimPrefix(rest, "=")
+
+	var args []string
+	var arg strings.Builder
+	inArg, quoted := false, false
+	for _, r := range rest {
+		switch {
+		case r == '"':
+			quoted = !quoted
+			inArg = true
+		case !quoted && (r == ' ' || r == '\t'):
+			if inArg {
+				args = append(args, arg.String())
+				arg.Reset()
+				inArg = false
+			}
+		case !quoted && r == '#' && !inArg:
+			return keyword, args
+		default:
+			arg.WriteRune(r)
+			inArg = true
+		}
+	}
+	if inArg {
+		args = append(args, arg.String())
+	}
+
+	return keyword, args
+}
+
+func appendPath(paths []string, path string) []string {
+	path = filepath.Clean(path)
+	for _, p := range paths {
+		if p == path {
+			return paths
+		}
+	}
+
+	return append(paths, path)
+}
@@ -0,0 +1,163 @@
+package identity
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/pem"
+	"os"
+	"os/user"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// testHome point HOME to a new directory holding an empty .ssh directory
+func testHome(t *testing.T) string {
+	t.Helper()
+
+	home := t.TempDir()
+	t.Setenv("HOME", home)
+	if err := os.Mkdir(filepath.Join(home, ".ssh"), 0o700); err != nil {
+		t.Fatal(err)
+	}
+
+	return home
+}
+
+func writeFile(t *testing.T, path, content string) {
+	t.Helper()
+
+	if err := os.MkdirAll(filepath.Dir(path), 0o700); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(path, []byte(content), 0o600); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestParseSSHConfig(t *testing.T) {
+	home := testHome(t)
+	t.Setenv("KEY_DIR", "/opt/keys")
+
+	u, err := user.Current()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	config := filepath.Join(home, ".ssh", "config")
+	writeFile(t, config, `# keys of every host
+Include conf.d/*
+IdentityFile ~/.ssh/id_work
+
+Host example.com
+  IdentityFile "%d/my keys/id_example" # quoted path with spaces
+  IdentityFile ~/.ssh/id_work
+  IdentityFile ~/.ssh/id_%h
+  CertificateFile=~/.ssh/id_example-cert.pub
+  ControlPath ~/.ssh/cm/%C
+
+Match all
+  IdentityFile none
+  IdentityFile ${KEY_DIR}/id_env
+  IdentityFile ${MISSING_DIR}/id_missing
+  ControlPath none
+`)
+	writeFile(t, filepath.Join(home, ".ssh", "conf.d", "users"), `Host *.internal
+	IdentityFile ~/.ssh/id_%u_%%
+	Include conf.d/users
+`)
+
+	got, err := ParseSSHConfig(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := &SSHConfig{
+		IdentityFiles: []string{
+			filepath.Join(home, ".ssh", "id_"+u.Username+"_%"),
+			filepath.Join(home, ".ssh", "id_work"),
+			filepath.Join(home, "my keys", "id_example"),
+			"/opt/keys/id_env",
+		},
+		CertificateFiles: []string{filepath.Join(home, ".ssh", "id_example-cert.pub")},
+		ControlDirs:      []string{filepath.Join(home, ".ssh", "cm")},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("ParseSSHConfig:\ngot  %+v\nwant %+v", got, want)
+	}
+}
+
+func TestParseSSHConfigIncludeDepth(t *testing.T) {
+	home := testHome(t)
+
+	// every file include the next one, deeper than OpenSSH allows
+	for i := 0; i <= maxIncludeDepth+1; i++ {
+		writeFile(t, filepath.Join(home, ".ssh", "nested", string(rune('a'+i))), "Include nested/"+string(rune('a'+i+1))+"\n")
+	}
+
+	if _, err := ParseSSHConfig(filepath.Join(home, ".ssh", "nested", "a")); err == nil {
+		t.Fatal("deeply nested Include: got no error")
+	}
+}
+
+func TestSplitConfigLine(t *testing.T) {
+	tests := []struct {
+		line    string
+		keyword string
+		args    []string
+	}{
+		{"", "", nil},
+		{"  # comment", "", nil},
+		{"IdentityFile ~/.ssh/id", "IdentityFile", []string{"~/.ssh/id"}},
+		{"IdentityFile=~/.ssh/id", "IdentityFile", []string{"~/.ssh/id"}},
+		{"IdentityFile = ~/.ssh/id", "IdentityFile", []string{"~/.ssh/id"}},
+		{"\tIdentityFile \"a b\" # comment", "IdentityFile", []string{"a b"}},
+		{"Include a b\tc", "Include", []string{"a", "b", "c"}},
+		{"Host", "Host", nil},
+	}
+
+	for _, tt := range tests {
+		keyword, args := splitConfigLine(tt.line)
+		if keyword != tt.keyword || !reflect.DeepEqual(args, tt.args) {
+			t.Errorf("splitConfigLine(%q) = %q, %q, want %q, %q", tt.line, keyword, args, tt.keyword, tt.args)
+		}
+	}
+}
+
+func TestDiscoverKeysSSHConfig(t *testing.T) {
+	home := testHome(t)
+
+	_, priv, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	block, err := ssh.MarshalPrivateKey(priv, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	signer, err := ssh.NewSignerFromKey(priv)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cert := &ssh.Certificate{Key: signer.PublicKey(), CertType: ssh.UserCert, ValidBefore: ssh.CertTimeInfinity}
+	if err = cert.SignCert(rand.Reader, signer); err != nil {
+		t.Fatal(err)
+	}
+
+	keyPath := filepath.Join(home, "keys", "id_far")
+	certPath := filepath.Join(home, "certs", "far.pub")
+	writeFile(t, keyPath, string(pem.EncodeToMemory(block)))
+	writeFile(t, certPath, string(ssh.MarshalAuthorizedKey(cert)))
+	writeFile(t, filepath.Join(home, ".ssh", "config"), "Host far\n  IdentityFile ~/keys/id_far\n  CertificateFile ~/certs/far.pub\n")
+
+	keys := DiscoverKeys()
+	if len(keys) != 1 {
+		t.Fatalf("discovered %d keys, want 1", len(keys))
+	}
+	if keys[0].Path != keyPath || keys[0].CertificatePath != certPath {
+		t.Errorf("discovered %q with certificate %q, want %q with %q", keys[0].Path, keys[0].CertificatePath, keyPath, certPath)
+	}
+}
@@ -2,54 +2,142 @@ package sshagent
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"net"
-	"os"
+	"sync"
+	"time"
 
+	"github.com/oomol-lab/ovm-ssh-agent/v3/pkg/identity"
 	"golang.org/x/crypto/ssh"
 	"golang.org/x/crypto/ssh/agent"
 )
 
+const (
+	// DefaultListTimeout the default deadline for listing keys from upstream agents
+	DefaultListTimeout = 5 * time.Second
+	// DefaultSignTimeout the default deadline for signing, long enough for interactive approval in the upstream agent
+	DefaultSignTimeout = 60 * time.Second
+)
+
 type SSHAgent struct {
 	localAgent      agent.ExtendedAgent
-	upstreamAgent   *upstreamAgent
+	upstreamAgents  []*upstreamAgent
 	localSocketFile string
 
+	// index route sign requests to the backend holding the key
+	index *keyIndex
+
+	listTimeout time.Duration
+	signTimeout time.Duration
+
+	// strict fail List when an upstream is unavailable, instead of skipping it
+	strict bool
+
+	// decrypter decrypt encrypted key files
+	decrypter *identity.Decrypter
+	// lazy encrypted keys waiting for their first sign request
+	lazy lazyKeys
+	// permissions what LoadLocalKeys does with key files failing the permission audit
+	permissions identity.PermissionPolicy
+	// files the key files loaded by LoadLocalKeys, kept in sync by WatchLocalKeys
+	files localFiles
+	// sources where each local key came from
+	sources keySources
+	// listPolicy how List label and order the keys
+	listPolicy ListPolicy
+
+	lock    proxyLock
+	idle    idleState
+	events  eventEmitter
+	confirm confirmState
+	certs   certTracker
+
+	resolveMu   sync.Mutex
+	resolver    UpstreamResolver
+	lastResolve map[*upstreamAgent]time.Time
+
 	context context.Context
 	cancel  context.CancelFunc
 }
 
 func NewSSHAgent(ctx context.Context, upstreamSocket, localSocketFile string) *SSHAgent {
+	return NewSSHAgentWithUpstreams(ctx, []string{upstreamSocket}, localSocketFile)
+}
+
+// NewSSHAgentWithUpstreams create agent with an ordered list of upstream sockets.
+// Keys are listed in the same order, and signatures are routed to the upstream holding the key.
+// An empty socket keep its place until the UpstreamResolver finds an agent, it is skipped until then.
+func NewSSHAgentWithUpstreams(ctx context.Context, upstreamSockets []string, localSocketFile string) *SSHAgent {
 	ctx, cancel := context.WithCancel(ctx)
 
 	sshAgent := &SSHAgent{
 		localAgent:      agent.NewKeyring().(agent.ExtendedAgent),
-		upstreamAgent:   newUpstreamAgent(upstreamSocket),
 		localSocketFile: localSocketFile,
+		index:           newKeyIndex(),
+		listTimeout:     DefaultListTimeout,
+		signTimeout:     DefaultSignTimeout,
+		lastResolve:     make(map[*upstreamAgent]time.Time),
 		context:         ctx,
 		cancel:          cancel,
 	}
 
+	for _, socket := range upstreamSockets {
+		sshAgent.AddUpstream(UnixUpstream(socket))
+	}
+
 	return sshAgent
 }
 
-// LoadLocalKeys load local keys from files
-func (s *SSHAgent) LoadLocalKeys(keys ...string) {
-	for _, f := range keys {
-		r, err := os.ReadFile(f)
-		if err != nil {
-			continue
-		}
+// AddUpstream append an upstream after the existing ones. Should be called before Serve.
+func (s *SSHAgent) AddUpstream(upstream Upstream) {
+	s.upstreamAgents = append(s.upstreamAgents, newUpstreamAgent(upstream, s.rediscover))
+}
 
-		privateKey, err := ssh.ParseRawPrivateKey(r)
-		if err != nil {
-			continue
-		}
+// SetListTimeout set the deadline of List, zero means no deadline. Should be called before Serve.
+func (s *SSHAgent) SetListTimeout(d time.Duration) {
+	s.listTimeout = d
+}
 
-		_ = s.localAgent.Add(agent.AddedKey{
-			PrivateKey: privateKey,
-		})
+// SetSignTimeout set the deadline of SignWithFlags, zero means no deadline. Should be called before Serve.
+func (s *SSHAgent) SetSignTimeout(d time.Duration) {
+	s.signTimeout = d
+}
+
+func withTimeout(ctx context.Context, d time.Duration) (context.Context, context.CancelFunc) {
+	if d <= 0 {
+		return context.WithCancel(ctx)
 	}
+
+	return context.WithTimeout(ctx, d)
+}
+
+// SetStrict make List fail with ErrUpstreamUnavailable when an upstream can not be reached,
+// instead of silently returning the keys of the remaining agents. An empty socket not resolved yet is always skipped.
+// Should be called before Serve.
+func (s *SSHAgent) SetStrict(strict bool) {
+	s.strict = strict
+}
+
+// UpstreamStatus return the health of every upstream, in order
+func (s *SSHAgent) UpstreamStatus() []UpstreamStatus {
+	status := make([]UpstreamStatus, 0, len(s.upstreamAgents))
+	for _, u := range s.upstreamAgents {
+		status = append(status, u.status())
+	}
+
+	return status
+}
+
+// skipUpstreamError report whether an upstream error degrades to skipping the upstream
+func (s *SSHAgent) skipUpstreamError(err error) bool {
+	return errors.Is(err, errNoUpstreamSocket) || !s.strict && errors.Is(err, ErrUpstreamUnavailable)
+}
+
+// SetPassphraseProvider set the provider asked for the passphrase of encrypted keys.
+// At most maxAttempts passphrases are tried per file, working passphrases are cached for the session.
+func (s *SSHAgent) SetPassphraseProvider(provider identity.PassphraseProvider, maxAttempts int) {
+	s.decrypter = identity.NewDecrypter(provider, maxAttempts)
 }
 
 func (s *SSHAgent) Serve() error {
@@ -68,7 +156,7 @@ func (s *SSHAgent) Serve() error {
 
 		if conn, err := listener.Accept(); err == nil {
 			go func(conn net.Conn) {
-				_ = agent.ServeAgent(s, conn)
+				_ = agent.ServeAgent(s.forPeer(peerOf(conn)), conn)
 			}(conn)
 		}
 	}
@@ -76,12 +164,58 @@ func (s *SSHAgent) Serve() error {
 
 // Remove only remove key from local agent
 func (s *SSHAgent) Remove(key ssh.PublicKey) error {
-	return s.localAgent.Remove(key)
+	if s.lock.isLocked() {
+		return ErrLocked
+	}
+
+	return s.removeLocal(key)
+}
+
+// removeLocal remove the key from the local agent together with its state, bypassing the lock
+func (s *SSHAgent) removeLocal(key ssh.PublicKey) error {
+	if k, ok := s.lazy.get(key); ok {
+		for _, pub := range k.publicKeys() {
+			s.deleteSource(pub)
+		}
+		s.lazy.delete(key)
+		return nil
+	}
+
+	if err := s.localAgent.Remove(key); err != nil {
+		return err
+	}
+
+	if owner, ok := s.index.get(key); ok && owner.isLocal() {
+		s.index.delete(key)
+	}
+	s.setConfirmRequired(key, false)
+	s.untrackCertificate(key)
+	s.deleteSource(key)
+	s.lazy.delete(key)
+	return nil
 }
 
 // RemoveAll only remove all key from local agent
 func (s *SSHAgent) RemoveAll() error {
-	return s.localAgent.RemoveAll()
+	if s.lock.isLocked() {
+		return ErrLocked
+	}
+
+	return s.forgetLocalKeys()
+}
+
+// forgetLocalKeys remove all local keys together with their state, bypassing the lock
+func (s *SSHAgent) forgetLocalKeys() error {
+	if err := s.localAgent.RemoveAll(); err != nil {
+		return err
+	}
+
+	s.index.removeOwner(localOwner)
+	s.clearConfirmRequired()
+	s.clearCertificates()
+	s.clearSources()
+	s.lazy.clear()
+	return nil
 }
 
 func (s *SSHAgent) Sign(key ssh.PublicKey, data []byte) (*ssh.Signature, error) {
@@ -90,76 +224,282 @@ func (s *SSHAgent) Sign(key ssh.PublicKey, data []byte) (*ssh.Signature, error)
 
 // Add only add private key into local agent
 func (s *SSHAgent) Add(key agent.AddedKey) error {
-	return s.localAgent.Add(key)
+	return s.addWithSource(key, KeySource{Kind: KeySourceAPI, Added: time.Now()})
+}
+
+// addWithSource add the key into local agent, and record where it came from
+func (s *SSHAgent) addWithSource(key agent.AddedKey, source KeySource) error {
+	if s.lock.isLocked() {
+		return ErrLocked
+	}
+
+	if err := s.localAgent.Add(key); err != nil {
+		return err
+	}
+
+	if pub, err := addedPublicKey(key); err == nil {
+		s.index.set(pub, localOwner)
+		s.setConfirmRequired(pub, key.ConfirmBeforeUse)
+		s.setSource(pub, source)
+	}
+	if key.Certificate != nil {
+		s.trackCertificate(key, "")
+	}
+	return nil
+}
+
+// addedPublicKey return the public key the keyring stores for the added key
+func addedPublicKey(key agent.AddedKey) (ssh.PublicKey, error) {
+	if key.Certificate != nil {
+		return key.Certificate, nil
+	}
+
+	signer, err := ssh.NewSignerFromKey(key.PrivateKey)
+	if err != nil {
+		return nil, err
+	}
+
+	return signer.PublicKey(), nil
 }
 
 func (s *SSHAgent) Extension(extensionType string, contents []byte) ([]byte, error) {
+	if s.lock.isLocked() {
+		return nil, ErrLocked
+	}
+
 	return s.localAgent.Extension(extensionType, contents)
 }
 
-// List return all keys from upstream and local agent
+// List return all keys from upstreams (in order) and local agent
 func (s *SSHAgent) List() ([]*agent.Key, error) {
-	keys := make([]*agent.Key, 0, 10)
+	return s.ListContext(s.context)
+}
 
-	uks, err := s.upstreamAgent.List()
+// ListContext is like List, but upstream calls are bounded by ctx and the list timeout.
+// A slow upstream returns an error wrapping ErrUpstreamTimeout. A locked agent list no keys, like ssh-agent.
+func (s *SSHAgent) ListContext(ctx context.Context) ([]*agent.Key, error) {
+	identities, err := s.listIdentities(ctx)
 	if err != nil {
-		return nil, fmt.Errorf("failed to list upstream keys: %w", err)
+		return nil, err
 	}
-	keys = append(keys, uks...)
 
-	lks, err := s.localAgent.List()
-	if err != nil {
-		return nil, fmt.Errorf("failed to list local keys: %w", err)
+	keys := make([]*agent.Key, 0, len(identities))
+	for _, id := range identities {
+		keys = append(keys, id.Key)
 	}
 
-	keys = append(keys, lks...)
 	return keys, nil
 }
 
-// Signers return all signers from upstream and local agent
-func (s *SSHAgent) Signers() (out []ssh.Signer, _ error) {
-	signer := make([]ssh.Signer, 0, 10)
+// listIdentities list the keys of all backends with their source, arranged by the list policy
+func (s *SSHAgent) listIdentities(ctx context.Context) ([]Identity, error) {
+	if s.lock.isLocked() {
+		return []Identity{}, nil
+	}
+	s.reloadCleared()
+
+	ctx, cancel := withTimeout(ctx, s.listTimeout)
+	defer cancel()
+
+	identities := make([]Identity, 0, 10)
 
-	uks, err := s.upstreamAgent.Signers()
+	for _, u := range s.upstreamAgents {
+		uks, err := u.List(ctx)
+		if s.skipUpstreamError(err) {
+			continue
+		}
+		if err != nil {
+			return nil, fmt.Errorf("failed to list upstream keys from %q: %w", u, err)
+		}
+		s.index.sync(keyOwner{upstream: u}, uks)
+
+		source := KeySource{Kind: KeySourceUpstream, Upstream: u.String()}
+		for _, k := range uks {
+			identities = append(identities, Identity{Key: k, Source: source})
+		}
+	}
+
+	now := time.Now()
+	s.expireCertificates(now)
+
+	lks, err := s.localAgent.List()
 	if err != nil {
-		return nil, fmt.Errorf("failed to get upstream signers: %w", err)
+		return nil, fmt.Errorf("failed to list local keys: %w", err)
+	}
+	s.index.sync(localOwner, lks)
+
+	for _, k := range append(lks, s.lazy.list(now)...) {
+		identities = append(identities, Identity{Key: k, Source: s.localSource(k)})
 	}
-	signer = append(signer, uks...)
 
-	localSigner, err := s.localAgent.Signers()
+	return s.arrangeIdentities(identities), nil
+}
+
+// Signers return signers for all keys from upstreams (in order) and local agent.
+// The signers sign through SignWithFlags, so they remain usable after the call, e.g. for ssh.PublicKeys.
+func (s *SSHAgent) Signers() ([]ssh.Signer, error) {
+	keys, err := s.List()
 	if err != nil {
-		return nil, fmt.Errorf("failed to get local signers: %w", err)
+		return nil, fmt.Errorf("failed to get signers: %w", err)
+	}
+
+	signers := make([]ssh.Signer, 0, len(keys))
+	for _, k := range keys {
+		pub, err := ssh.ParsePublicKey(k.Blob)
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse public key %q: %w", k.Comment, err)
+		}
+
+		signers = append(signers, &agentSigner{
+			agent: s,
+			pub:   pub,
+		})
 	}
 
-	signer = append(signer, localSigner...)
-	return signer, nil
+	return signers, nil
 }
 
-// SignWithFlags generate signature a with public key from upstream and local agent
+// SignWithFlags generate signature a with public key from the backend holding it.
+// The owner is looked up from the key index, all backends are scanned only on cache miss.
 func (s *SSHAgent) SignWithFlags(key ssh.PublicKey, data []byte, flags agent.SignatureFlags) (*ssh.Signature, error) {
-	if signature, err := s.upstreamAgent.SignWithFlags(key, data, flags); err == nil {
-		return signature, nil
+	return s.SignWithFlagsContext(s.context, key, data, flags)
+}
+
+// SignWithFlagsContext is like SignWithFlags, but upstream calls are bounded by ctx and the sign timeout.
+// A slow upstream returns an error wrapping ErrUpstreamTimeout, a key held by no backend returns ErrKeyNotFound.
+func (s *SSHAgent) SignWithFlagsContext(ctx context.Context, key ssh.PublicKey, data []byte, flags agent.SignatureFlags) (*ssh.Signature, error) {
+	if s.lock.isLocked() {
+		return nil, ErrLocked
+	}
+	s.touchIdle()
+	s.reloadCleared()
+
+	ctx, cancel := withTimeout(ctx, s.signTimeout)
+	defer cancel()
+
+	// the Confirmer is asked once, only when a backend holding the key is about to sign
+	confirmed := false
+	confirm := func() error {
+		if confirmed {
+			return nil
+		}
+		if err := s.confirmSign(ctx, key, data, flags); err != nil {
+			return err
+		}
+		confirmed = true
+		return nil
+	}
+
+	if owner, ok := s.index.get(key); ok {
+		if err := confirm(); err != nil {
+			return nil, err
+		}
+
+		signature, err := s.signWith(ctx, owner, key, data, flags)
+		if err == nil {
+			return signature, nil
+		}
+
+		// a timed out upstream or an owner still holding the key means the failure is not caused by a stale index
+		if !owner.isLocal() && (ctx.Err() != nil || owner.upstream.has(ctx, key)) {
+			return nil, fmt.Errorf("failed to sign with upstream key from %q: %w", owner.upstream, err)
+		}
+		s.index.delete(key)
+	}
+
+	if k, ok := s.lazy.get(key); ok {
+		if err := confirm(); err != nil {
+			return nil, err
+		}
+		if err := s.decryptLazy(ctx, k); err != nil {
+			return nil, err
+		}
+		return s.localAgent.SignWithFlags(key, data, flags)
+	}
+
+	var upstreamErr error
+	for _, u := range s.upstreamAgents {
+		uks, err := u.List(ctx)
+		if s.skipUpstreamError(err) {
+			continue
+		}
+		if err != nil {
+			upstreamErr = fmt.Errorf("failed to list upstream keys from %q: %w", u, err)
+			continue
+		}
+		s.index.sync(keyOwner{upstream: u}, uks)
+
+		if !containsKey(uks, key) {
+			continue
+		}
+
+		if err = confirm(); err != nil {
+			return nil, err
+		}
+		signature, err := u.SignWithFlags(ctx, key, data, flags)
+		if err == nil {
+			return signature, nil
+		}
+		upstreamErr = fmt.Errorf("failed to sign with upstream key from %q: %w", u, err)
 	}
 
+	lks, err := s.localAgent.List()
+	if err != nil {
+		return nil, fmt.Errorf("failed to list local keys: %w", errors.Join(err, upstreamErr))
+	}
+	if !containsKey(lks, key) {
+		if upstreamErr != nil {
+			return nil, upstreamErr
+		}
+		return nil, fmt.Errorf("%w: %s", ErrKeyNotFound, ssh.FingerprintSHA256(key))
+	}
+
+	if err = confirm(); err != nil {
+		return nil, err
+	}
 	signature, err := s.localAgent.SignWithFlags(key, data, flags)
 	if err != nil {
-		return nil, fmt.Errorf("failed to sign with local and upstream key: %w", err)
+		return nil, fmt.Errorf("failed to sign with local and upstream key: %w", errors.Join(err, upstreamErr))
 	}
+	s.index.set(key, localOwner)
 
 	return signature, nil
 }
 
-// Unlock only unlock local agent
+func (s *SSHAgent) signWith(ctx context.Context, owner keyOwner, key ssh.PublicKey, data []byte, flags agent.SignatureFlags) (*ssh.Signature, error) {
+	if owner.isLocal() {
+		return s.localAgent.SignWithFlags(key, data, flags)
+	}
+
+	return owner.upstream.SignWithFlags(ctx, key, data, flags)
+}
+
+// Unlock unlock the whole agent. After an incorrect passphrase,
+// further attempts fail with ErrUnlockThrottled for an exponentially growing delay.
 func (s *SSHAgent) Unlock(passphrase []byte) error {
-	return s.localAgent.Unlock(passphrase)
+	if err := s.lock.unlock(passphrase); err != nil {
+		return err
+	}
+
+	s.touchIdle()
+	s.emit(EventUnlocked, "")
+	return nil
 }
 
-// Lock only lock local agent
+// Lock lock the whole agent, upstream and local keys can not be listed or used until Unlock
 func (s *SSHAgent) Lock(passphrase []byte) error {
-	return s.localAgent.Lock(passphrase)
+	if err := s.lock.lock(passphrase); err != nil {
+		return err
+	}
+
+	s.emit(EventLocked, "client request")
+	return nil
 }
 
 func (s *SSHAgent) Close() {
 	s.cancel()
-	_ = s.upstreamAgent.Close()
+	s.stopIdle()
+	for _, u := range s.upstreamAgents {
+		_ = u.Close()
+	}
 }
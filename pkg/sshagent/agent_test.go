@@ -0,0 +1,242 @@
+package sshagent
+
+import (
+	"context"
+	"crypto/ed25519"
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"net"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/agent"
+)
+
+// testUpstream serve an in-memory keyring on a unix socket
+func testUpstream(t *testing.T) (string, agent.Agent) {
+	t.Helper()
+
+	keyring := agent.NewKeyring()
+	return serveTestUpstream(t, keyring), keyring
+}
+
+// serveTestUpstream serve the agent on a unix socket until the test ends
+func serveTestUpstream(t *testing.T, a agent.Agent) string {
+	t.Helper()
+
+	socket := filepath.Join(t.TempDir(), "upstream.sock")
+	listener, err := net.Listen("unix", socket)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = listener.Close() })
+
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				_ = agent.ServeAgent(a, conn)
+			}()
+		}
+	}()
+
+	return socket
+}
+
+// addTestKey add a new ed25519 key to the agent and return its public key
+func addTestKey(t *testing.T, a agent.Agent, comment string) ssh.PublicKey {
+	t.Helper()
+
+	_, priv, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err = a.Add(agent.AddedKey{PrivateKey: priv, Comment: comment}); err != nil {
+		t.Fatal(err)
+	}
+
+	signer, err := ssh.NewSignerFromKey(priv)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return signer.PublicKey()
+}
+
+// serveTestAgent run Serve until the test ends, and return the local socket once it accepts connections
+func serveTestAgent(t *testing.T, a *SSHAgent) string {
+	t.Helper()
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		_ = a.Serve()
+	}()
+	t.Cleanup(func() {
+		a.Close()
+		<-done
+	})
+
+	for i := 0; i < 100; i++ {
+		if conn, err := net.Dial("unix", a.localSocketFile); err == nil {
+			_ = conn.Close()
+			return a.localSocketFile
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	t.Fatal("agent did not start serving")
+	return ""
+}
+
+func TestParallelClients(t *testing.T) {
+	socket1, upstream1 := testUpstream(t)
+	socket2, upstream2 := testUpstream(t)
+
+	a := NewSSHAgentWithUpstreams(context.Background(), []string{socket1, socket2}, filepath.Join(t.TempDir(), "agent.sock"))
+	keys := []ssh.PublicKey{
+		addTestKey(t, upstream1, "upstream1"),
+		addTestKey(t, upstream2, "upstream2"),
+		addTestKey(t, a, "local"),
+	}
+	socket := serveTestAgent(t, a)
+
+	const clients, requests = 32, 20
+
+	var wg sync.WaitGroup
+	errs := make(chan error, clients)
+	for i := 0; i < clients; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+
+			conn, err := net.Dial("unix", socket)
+			if err != nil {
+				errs <- err
+				return
+			}
+			defer conn.Close()
+
+			client := agent.NewClient(conn)
+			for j := 0; j < requests; j++ {
+				listed, err := client.List()
+				if err != nil {
+					errs <- fmt.Errorf("client %d: list: %w", i, err)
+					return
+				}
+				if len(listed) != len(keys) {
+					errs <- fmt.Errorf("client %d: listed %d keys, want %d", i, len(listed), len(keys))
+					return
+				}
+
+				key := keys[(i+j)%len(keys)]
+				data := []byte(fmt.Sprintf("client %d request %d", i, j))
+				signature, err := client.Sign(key, data)
+				if err != nil {
+					errs <- fmt.Errorf("client %d: sign: %w", i, err)
+					return
+				}
+				if err = key.Verify(data, signature); err != nil {
+					errs <- fmt.Errorf("client %d: verify: %w", i, err)
+					return
+				}
+			}
+		}(i)
+	}
+
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		t.Error(err)
+	}
+}
+
+func TestParallelClientsUpstreamRestart(t *testing.T) {
+	socket, upstream := testUpstream(t)
+
+	a := NewSSHAgent(context.Background(), socket, filepath.Join(t.TempDir(), "agent.sock"))
+	key := addTestKey(t, upstream, "upstream")
+	local := serveTestAgent(t, a)
+
+	// drop the pooled connections while clients are signing, the calls must reconnect instead of racing
+	stop := make(chan struct{})
+	go func() {
+		for {
+			select {
+			case <-stop:
+				return
+			case <-time.After(5 * time.Millisecond):
+				a.upstreamAgents[0].setUpstream(UnixUpstream(socket))
+			}
+		}
+	}()
+	defer close(stop)
+
+	var wg sync.WaitGroup
+	errs := make(chan error, 16)
+	for i := 0; i < 16; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+
+			conn, err := net.Dial("unix", local)
+			if err != nil {
+				errs <- err
+				return
+			}
+			defer conn.Close()
+
+			client := agent.NewClient(conn)
+			for j := 0; j < 20; j++ {
+				signature, err := client.Sign(key, []byte("data"))
+				if err != nil {
+					errs <- err
+					return
+				}
+				if err = key.Verify([]byte("data"), signature); err != nil {
+					errs <- err
+					return
+				}
+			}
+		}()
+	}
+
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		t.Error(err)
+	}
+}
+
+func TestStrictUpstreamUnavailable(t *testing.T) {
+	missing := filepath.Join(t.TempDir(), "missing.sock")
+
+	a := NewSSHAgent(context.Background(), missing, filepath.Join(t.TempDir(), "agent.sock"))
+	defer a.Close()
+	addTestKey(t, a, "local")
+
+	// by default the dead upstream is skipped
+	keys, err := a.List()
+	if err != nil || len(keys) != 1 {
+		t.Fatalf("non-strict list: %d keys, err %v, want the local key", len(keys), err)
+	}
+
+	a.SetStrict(true)
+	if _, err = a.List(); !errors.Is(err, ErrUpstreamUnavailable) {
+		t.Fatalf("strict list: got %v, want ErrUpstreamUnavailable", err)
+	}
+
+	status := a.UpstreamStatus()
+	if len(status) != 1 || status[0].Healthy || status[0].Socket != missing || !errors.Is(status[0].LastError, ErrUpstreamUnavailable) {
+		t.Fatalf("upstream status %+v, want unhealthy with ErrUpstreamUnavailable", status)
+	}
+}
@@ -0,0 +1,287 @@
+package sshagent
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"math"
+	"os"
+	"os/exec"
+	"sync"
+	"time"
+
+	"github.com/oomol-lab/ovm-ssh-agent/v3/pkg/identity"
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/agent"
+)
+
+const (
+	// DefaultCertificateWarnBefore how long before expiry EventCertificateExpiring is emitted
+	DefaultCertificateWarnBefore = 24 * time.Hour
+	// DefaultCertificateCheckInterval how often certificates are checked for expiry
+	DefaultCertificateCheckInterval = time.Minute
+
+	// certificateRenewRetry the delay between two renewal attempts of the same certificate
+	certificateRenewRetry = 5 * time.Minute
+	// certificateRenewTimeout the deadline of one renewal attempt
+	certificateRenewTimeout = time.Minute
+)
+
+// CertificateRenewer issue a new certificate for the key of an expiring certificate
+type CertificateRenewer interface {
+	// Renew return the new certificate, certPath is the file the certificate was loaded from, empty when unknown
+	Renew(ctx context.Context, cert *ssh.Certificate, certPath string) (*ssh.Certificate, error)
+}
+
+// CommandRenewer run a program printing the new certificate to stdout, in authorized_keys format.
+// The program find the certificate to renew in SSH_CERT_FILE, SSH_CERT_KEY_ID and SSH_CERT_PUBLIC_KEY.
+type CommandRenewer struct {
+	Command string
+	Args    []string
+}
+
+func (c *CommandRenewer) Renew(ctx context.Context, cert *ssh.Certificate, certPath string) (*ssh.Certificate, error) {
+	cmd := exec.CommandContext(ctx, c.Command, c.Args...)
+	cmd.Env = append(os.Environ(),
+		"SSH_CERT_FILE="+certPath,
+		"SSH_CERT_KEY_ID="+cert.KeyId,
+		"SSH_CERT_PUBLIC_KEY="+string(bytes.TrimSpace(ssh.MarshalAuthorizedKey(cert.Key))),
+	)
+
+	output, err := cmd.Output()
+	if err != nil {
+		return nil, fmt.Errorf("failed to run renewal command: %w", err)
+	}
+
+	pub, _, _, _, err := ssh.ParseAuthorizedKey(output)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse renewed certificate: %w", err)
+	}
+
+	renewed, ok := pub.(*ssh.Certificate)
+	if !ok {
+		return nil, fmt.Errorf("renewal command did not print a certificate")
+	}
+
+	return renewed, nil
+}
+
+// CertificatePolicy control the expiry warnings and renewal of certificates held by the local agent.
+// Expired certificates are always dropped from the local agent, with or without a policy.
+type CertificatePolicy struct {
+	// WarnBefore emit EventCertificateExpiring this long before expiry, zero use DefaultCertificateWarnBefore
+	WarnBefore time.Duration
+	// CheckInterval how often certificates are checked, zero use DefaultCertificateCheckInterval
+	CheckInterval time.Duration
+	// Renewer renew certificates expiring within RenewBefore, nil disable renewal
+	Renewer CertificateRenewer
+	// RenewBefore how long before expiry the Renewer is run, zero use WarnBefore
+	RenewBefore time.Duration
+}
+
+// trackedCert a certificate held by the local agent
+type trackedCert struct {
+	key agent.AddedKey
+	// path the file the certificate was loaded from, empty when added by a client
+	path      string
+	warned    bool
+	lastRenew time.Time
+}
+
+type certTracker struct {
+	mu      sync.Mutex
+	certs   map[string]*trackedCert
+	policy  CertificatePolicy
+	started bool
+}
+
+// SetCertificatePolicy set the certificate policy, and start checking certificates in the background until Close
+func (s *SSHAgent) SetCertificatePolicy(policy CertificatePolicy) {
+	if policy.WarnBefore <= 0 {
+		policy.WarnBefore = DefaultCertificateWarnBefore
+	}
+	if policy.CheckInterval <= 0 {
+		policy.CheckInterval = DefaultCertificateCheckInterval
+	}
+	if policy.RenewBefore <= 0 {
+		policy.RenewBefore = policy.WarnBefore
+	}
+
+	s.certs.mu.Lock()
+	s.certs.policy = policy
+	started := s.certs.started
+	s.certs.started = true
+	s.certs.mu.Unlock()
+
+	if !started {
+		go s.monitorCertificates()
+	}
+}
+
+func (s *SSHAgent) monitorCertificates() {
+	for {
+		s.certs.mu.Lock()
+		interval := s.certs.policy.CheckInterval
+		s.certs.mu.Unlock()
+
+		select {
+		case <-s.context.Done():
+			return
+		case <-time.After(interval):
+			s.checkCertificates()
+		}
+	}
+}
+
+// trackCertificate remember a certificate added to the local agent
+func (s *SSHAgent) trackCertificate(key agent.AddedKey, path string) {
+	s.certs.mu.Lock()
+	defer s.certs.mu.Unlock()
+
+	if s.certs.certs == nil {
+		s.certs.certs = make(map[string]*trackedCert)
+	}
+
+	fp := ssh.FingerprintSHA256(key.Certificate)
+	if old, ok := s.certs.certs[fp]; ok && path == "" {
+		path = old.path
+	}
+	s.certs.certs[fp] = &trackedCert{key: key, path: path}
+}
+
+func (s *SSHAgent) untrackCertificate(key ssh.PublicKey) {
+	s.certs.mu.Lock()
+	defer s.certs.mu.Unlock()
+
+	delete(s.certs.certs, ssh.FingerprintSHA256(key))
+}
+
+func (s *SSHAgent) clearCertificates() {
+	s.certs.mu.Lock()
+	defer s.certs.mu.Unlock()
+
+	s.certs.certs = nil
+}
+
+// expireCertificates drop the certificates expired at now from the local agent
+func (s *SSHAgent) expireCertificates(now time.Time) {
+	var expired []*ssh.Certificate
+
+	s.certs.mu.Lock()
+	for fp, c := range s.certs.certs {
+		if validBefore(c.key.Certificate).After(now) {
+			continue
+		}
+
+		delete(s.certs.certs, fp)
+		expired = append(expired, c.key.Certificate)
+	}
+	s.certs.mu.Unlock()
+
+	for _, cert := range expired {
+		s.dropCertificate(cert)
+		s.emit(EventCertificateExpired, fmt.Sprintf("certificate %q (%s) expired", cert.KeyId, ssh.FingerprintSHA256(cert)))
+	}
+}
+
+// dropCertificate remove the certificate from the local agent, bypassing the lock
+func (s *SSHAgent) dropCertificate(cert *ssh.Certificate) {
+	_ = s.localAgent.Remove(cert)
+
+	if owner, ok := s.index.get(cert); ok && owner.isLocal() {
+		s.index.delete(cert)
+	}
+	s.setConfirmRequired(cert, false)
+	s.deleteSource(cert)
+}
+
+// checkCertificates drop expired certificates, then renew or warn about the ones expiring soon
+func (s *SSHAgent) checkCertificates() {
+	now := time.Now()
+	s.expireCertificates(now)
+
+	s.certs.mu.Lock()
+	policy := s.certs.policy
+	var renew, warn []*trackedCert
+	for _, c := range s.certs.certs {
+		left := validBefore(c.key.Certificate).Sub(now)
+
+		if policy.Renewer != nil && left <= policy.RenewBefore && now.Sub(c.lastRenew) >= certificateRenewRetry && !s.lock.isLocked() {
+			c.lastRenew = now
+			renew = append(renew, c)
+			continue
+		}
+
+		if !c.warned && left <= policy.WarnBefore {
+			c.warned = true
+			warn = append(warn, c)
+		}
+	}
+	s.certs.mu.Unlock()
+
+	for _, c := range warn {
+		cert := c.key.Certificate
+		s.emit(EventCertificateExpiring, fmt.Sprintf("certificate %q (%s) expires at %s", cert.KeyId, ssh.FingerprintSHA256(cert), validBefore(cert)))
+	}
+
+	for _, c := range renew {
+		cert := c.key.Certificate
+		if err := s.renewCertificate(policy.Renewer, c); err != nil {
+			s.emit(EventCertificateRenewalFailed, fmt.Sprintf("certificate %q (%s): %v", cert.KeyId, ssh.FingerprintSHA256(cert), err))
+		}
+	}
+}
+
+// renewCertificate replace the certificate with the one issued by the renewer
+func (s *SSHAgent) renewCertificate(renewer CertificateRenewer, c *trackedCert) error {
+	ctx, cancel := context.WithTimeout(s.context, certificateRenewTimeout)
+	defer cancel()
+
+	old := c.key.Certificate
+	cert, err := renewer.Renew(ctx, old, c.path)
+	if err != nil {
+		return err
+	}
+
+	if ssh.FingerprintSHA256(cert.Key) != ssh.FingerprintSHA256(old.Key) {
+		return fmt.Errorf("renewed certificate does not match key %s", ssh.FingerprintSHA256(old.Key))
+	}
+
+	if err = identity.CheckCertificateValidity(cert, time.Now()); err != nil {
+		return fmt.Errorf("renewed certificate is not valid: %w", err)
+	}
+
+	source, ok := s.sourceOf(old)
+	if !ok {
+		source = KeySource{Kind: KeySourceAPI}
+	}
+	source.Added = time.Now()
+
+	key := c.key
+	key.Certificate = cert
+	if err = s.addWithSource(key, source); err != nil {
+		return fmt.Errorf("failed to add renewed certificate: %w", err)
+	}
+	s.trackCertificate(key, c.path)
+
+	if ssh.FingerprintSHA256(cert) != ssh.FingerprintSHA256(old) {
+		s.untrackCertificate(old)
+		s.dropCertificate(old)
+	}
+
+	message := fmt.Sprintf("certificate %q (%s) renewed until %s", cert.KeyId, ssh.FingerprintSHA256(cert), validBefore(cert))
+	if cert.ValidBefore == ssh.CertTimeInfinity {
+		message = fmt.Sprintf("certificate %q (%s) renewed without expiry", cert.KeyId, ssh.FingerprintSHA256(cert))
+	}
+	s.emit(EventCertificateRenewed, message)
+	return nil
+}
+
+// validBefore return the expiry of the certificate, the far future for certificates valid forever
+func validBefore(cert *ssh.Certificate) time.Time {
+	if cert.ValidBefore > math.MaxInt64 {
+		return time.Unix(1<<62, 0)
+	}
+
+	return time.Unix(int64(cert.ValidBefore), 0)
+}
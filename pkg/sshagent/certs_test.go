@@ -0,0 +1,176 @@
+package sshagent
+
+import (
+	"context"
+	"crypto/ed25519"
+	"crypto/rand"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/agent"
+)
+
+// testCertificates sign user certificates of one key with one CA
+type testCertificates struct {
+	t   *testing.T
+	key ed25519.PrivateKey
+	pub ssh.PublicKey
+	ca  ssh.Signer
+}
+
+func newTestCertificates(t *testing.T) *testCertificates {
+	t.Helper()
+
+	_, key, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, caKey, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pub, err := ssh.NewPublicKey(key.Public())
+	if err != nil {
+		t.Fatal(err)
+	}
+	ca, err := ssh.NewSignerFromKey(caKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return &testCertificates{t: t, key: key, pub: pub, ca: ca}
+}
+
+// issue sign a certificate valid from now for d
+func (c *testCertificates) issue(keyID string, d time.Duration) *ssh.Certificate {
+	c.t.Helper()
+
+	cert := &ssh.Certificate{
+		Key:         c.pub,
+		KeyId:       keyID,
+		CertType:    ssh.UserCert,
+		ValidAfter:  uint64(time.Now().Add(-time.Minute).Unix()),
+		ValidBefore: uint64(time.Now().Add(d).Unix()),
+	}
+	if err := cert.SignCert(rand.Reader, c.ca); err != nil {
+		c.t.Fatal(err)
+	}
+
+	return cert
+}
+
+// recordEvents record the events of the agent by type
+func recordEvents(a *SSHAgent) func(EventType) int {
+	var mu sync.Mutex
+	events := make(map[EventType]int)
+	a.SetEventHandler(func(event Event) {
+		mu.Lock()
+		defer mu.Unlock()
+
+		events[event.Type]++
+	})
+
+	return func(t EventType) int {
+		mu.Lock()
+		defer mu.Unlock()
+
+		return events[t]
+	}
+}
+
+// renewerFunc adapt a function to CertificateRenewer
+type renewerFunc func(ctx context.Context, cert *ssh.Certificate, certPath string) (*ssh.Certificate, error)
+
+func (f renewerFunc) Renew(ctx context.Context, cert *ssh.Certificate, certPath string) (*ssh.Certificate, error) {
+	return f(ctx, cert, certPath)
+}
+
+func TestCertificateExpired(t *testing.T) {
+	a := NewSSHAgent(context.Background(), "", filepath.Join(t.TempDir(), "agent.sock"))
+	defer a.Close()
+	events := recordEvents(a)
+
+	certs := newTestCertificates(t)
+	cert := certs.issue("short", time.Hour)
+	if err := a.Add(agent.AddedKey{PrivateKey: certs.key, Certificate: cert}); err != nil {
+		t.Fatal(err)
+	}
+
+	a.expireCertificates(time.Now().Add(2 * time.Hour))
+
+	keys, err := a.localAgent.List()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if containsKey(keys, cert) {
+		t.Fatal("expired certificate is still held")
+	}
+	if events(EventCertificateExpired) != 1 {
+		t.Fatalf("%d expired events, want 1", events(EventCertificateExpired))
+	}
+}
+
+func TestCertificateExpiring(t *testing.T) {
+	a := NewSSHAgent(context.Background(), "", filepath.Join(t.TempDir(), "agent.sock"))
+	defer a.Close()
+	events := recordEvents(a)
+
+	certs := newTestCertificates(t)
+	if err := a.Add(agent.AddedKey{PrivateKey: certs.key, Certificate: certs.issue("soon", 30*time.Minute)}); err != nil {
+		t.Fatal(err)
+	}
+	if err := a.Add(agent.AddedKey{PrivateKey: certs.key, Certificate: certs.issue("later", 48*time.Hour)}); err != nil {
+		t.Fatal(err)
+	}
+
+	a.SetCertificatePolicy(CertificatePolicy{WarnBefore: time.Hour, CheckInterval: time.Hour})
+	a.checkCertificates()
+	a.checkCertificates()
+
+	// only the certificate expiring within WarnBefore is reported, and only once
+	if events(EventCertificateExpiring) != 1 {
+		t.Fatalf("%d expiring events, want 1", events(EventCertificateExpiring))
+	}
+}
+
+func TestCertificateRenewal(t *testing.T) {
+	a := NewSSHAgent(context.Background(), "", filepath.Join(t.TempDir(), "agent.sock"))
+	defer a.Close()
+	events := recordEvents(a)
+
+	certs := newTestCertificates(t)
+	old := certs.issue("old", 30*time.Minute)
+	if err := a.Add(agent.AddedKey{PrivateKey: certs.key, Certificate: old}); err != nil {
+		t.Fatal(err)
+	}
+
+	var renewed *ssh.Certificate
+	renewer := renewerFunc(func(_ context.Context, cert *ssh.Certificate, _ string) (*ssh.Certificate, error) {
+		if cert.KeyId != "old" {
+			t.Errorf("renewing %q, want the old certificate", cert.KeyId)
+		}
+		renewed = certs.issue("renewed", 48*time.Hour)
+		return renewed, nil
+	})
+
+	// a zero RenewBefore renew within WarnBefore
+	a.SetCertificatePolicy(CertificatePolicy{WarnBefore: time.Hour, CheckInterval: time.Hour, Renewer: renewer})
+	a.checkCertificates()
+
+	if renewed == nil {
+		t.Fatal("the certificate was not renewed")
+	}
+	keys, err := a.localAgent.List()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if containsKey(keys, old) || !containsKey(keys, renewed) {
+		t.Fatal("renewed certificate did not replace the old one")
+	}
+	if events(EventCertificateRenewed) != 1 || events(EventCertificateExpiring) != 0 {
+		t.Fatalf("%d renewed and %d expiring events, want 1 and 0", events(EventCertificateRenewed), events(EventCertificateExpiring))
+	}
+}
@@ -0,0 +1,205 @@
+package sshagent
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"os/exec"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/agent"
+)
+
+// ConfirmRequest describe a sign request waiting for approval
+type ConfirmRequest struct {
+	Key         ssh.PublicKey
+	Fingerprint string
+	Flags       agent.SignatureFlags
+	// ConfirmRequired the key was added with ConfirmBeforeUse
+	ConfirmRequired bool
+	// Peer the client asking for the signature, nil when unknown
+	Peer    *Peer
+	Request SignRequest
+}
+
+// Confirmer approve sign requests, it is invoked before every SignWithFlags of a key held by the agent or an upstream.
+// A nil error approve the request.
+type Confirmer interface {
+	Confirm(ctx context.Context, req ConfirmRequest) error
+}
+
+// ConfirmFunc adapt an in-process callback to Confirmer
+type ConfirmFunc func(ctx context.Context, req ConfirmRequest) error
+
+func (f ConfirmFunc) Confirm(ctx context.Context, req ConfirmRequest) error {
+	return f(ctx, req)
+}
+
+// CommandConfirmer run an SSH_ASKPASS style program with the prompt as last argument,
+// a zero exit status approve the request.
+type CommandConfirmer struct {
+	Command string
+	Args    []string
+}
+
+func (c *CommandConfirmer) Confirm(ctx context.Context, req ConfirmRequest) error {
+	args := make([]string, 0, len(c.Args)+1)
+	args = append(args, c.Args...)
+	args = append(args, confirmPrompt(req))
+
+	cmd := exec.CommandContext(ctx, c.Command, args...)
+	cmd.Env = append(os.Environ(), "SSH_ASKPASS_PROMPT=confirm")
+
+	if err := cmd.Run(); err != nil {
+		return fmt.Errorf("%w: %w", ErrConfirmDenied, err)
+	}
+
+	return nil
+}
+
+func confirmPrompt(req ConfirmRequest) string {
+	prompt := fmt.Sprintf("Allow use of key %s?", req.Fingerprint)
+
+	switch req.Request.Kind {
+	case SignRequestUserAuth:
+		prompt += fmt.Sprintf("\nAuthenticating as %q.", req.Request.User)
+	case SignRequestSSHSig:
+		prompt += fmt.Sprintf("\nSigning data in namespace %q.", req.Request.Namespace)
+	}
+
+	if req.Peer != nil {
+		prompt += fmt.Sprintf("\nRequested by %s.", req.Peer)
+	}
+
+	return prompt
+}
+
+// CachingConfirmer remember approvals of the wrapped Confirmer per peer and key for ttl.
+// Keys added with ConfirmBeforeUse and requests without peer are always confirmed.
+func CachingConfirmer(c Confirmer, ttl time.Duration) Confirmer {
+	return &cachingConfirmer{
+		confirmer: c,
+		ttl:       ttl,
+		approved:  make(map[approvalKey]time.Time),
+	}
+}
+
+type approvalKey struct {
+	peer        Peer
+	fingerprint string
+}
+
+type cachingConfirmer struct {
+	confirmer Confirmer
+	ttl       time.Duration
+
+	mu       sync.Mutex
+	approved map[approvalKey]time.Time
+}
+
+func (c *cachingConfirmer) Confirm(ctx context.Context, req ConfirmRequest) error {
+	if req.ConfirmRequired || req.Peer == nil {
+		return c.confirmer.Confirm(ctx, req)
+	}
+
+	key := approvalKey{peer: *req.Peer, fingerprint: req.Fingerprint}
+
+	c.mu.Lock()
+	expiry, ok := c.approved[key]
+	c.mu.Unlock()
+	if ok && time.Now().Before(expiry) {
+		return nil
+	}
+
+	if err := c.confirmer.Confirm(ctx, req); err != nil {
+		return err
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	now := time.Now()
+	for k, e := range c.approved {
+		if now.After(e) {
+			delete(c.approved, k)
+		}
+	}
+	c.approved[key] = now.Add(c.ttl)
+
+	return nil
+}
+
+type confirmState struct {
+	mu        sync.RWMutex
+	confirmer Confirmer
+	// required the fingerprints of keys added with ConfirmBeforeUse
+	required map[string]struct{}
+}
+
+// SetConfirmer set the Confirmer invoked before every sign request of a held key, nil disable confirmation.
+// Without Confirmer, keys added with ConfirmBeforeUse are refused.
+func (s *SSHAgent) SetConfirmer(confirmer Confirmer) {
+	s.confirm.mu.Lock()
+	defer s.confirm.mu.Unlock()
+
+	s.confirm.confirmer = confirmer
+}
+
+func (s *SSHAgent) setConfirmRequired(key ssh.PublicKey, required bool) {
+	s.confirm.mu.Lock()
+	defer s.confirm.mu.Unlock()
+
+	if s.confirm.required == nil {
+		s.confirm.required = make(map[string]struct{})
+	}
+
+	fp := ssh.FingerprintSHA256(key)
+	if required {
+		s.confirm.required[fp] = struct{}{}
+	} else {
+		delete(s.confirm.required, fp)
+	}
+}
+
+func (s *SSHAgent) clearConfirmRequired() {
+	s.confirm.mu.Lock()
+	defer s.confirm.mu.Unlock()
+
+	s.confirm.required = nil
+}
+
+// confirmSign ask the Confirmer to approve the sign request
+func (s *SSHAgent) confirmSign(ctx context.Context, key ssh.PublicKey, data []byte, flags agent.SignatureFlags) error {
+	fp := ssh.FingerprintSHA256(key)
+
+	s.confirm.mu.RLock()
+	confirmer := s.confirm.confirmer
+	_, required := s.confirm.required[fp]
+	s.confirm.mu.RUnlock()
+
+	if confirmer == nil {
+		if required {
+			return fmt.Errorf("%w: no confirmer for key %s", ErrConfirmDenied, fp)
+		}
+		return nil
+	}
+
+	req := ConfirmRequest{
+		Key:             key,
+		Fingerprint:     fp,
+		Flags:           flags,
+		ConfirmRequired: required,
+		Request:         decodeSignRequest(data),
+	}
+	if peer, ok := PeerFromContext(ctx); ok {
+		req.Peer = &peer
+	}
+
+	if err := confirmer.Confirm(ctx, req); err != nil {
+		return fmt.Errorf("failed to confirm key %s: %w", fp, err)
+	}
+
+	return nil
+}
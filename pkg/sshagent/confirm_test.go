@@ -0,0 +1,142 @@
+package sshagent
+
+import (
+	"context"
+	"crypto/ed25519"
+	"crypto/rand"
+	"errors"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/agent"
+)
+
+func TestConfirmBeforeUseWithoutConfirmer(t *testing.T) {
+	a := NewSSHAgent(context.Background(), "", filepath.Join(t.TempDir(), "agent.sock"))
+	defer a.Close()
+
+	_, priv, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = a.Add(agent.AddedKey{PrivateKey: priv, ConfirmBeforeUse: true}); err != nil {
+		t.Fatal(err)
+	}
+	signer, err := ssh.NewSignerFromKey(priv)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err = a.Sign(signer.PublicKey(), []byte("data")); !errors.Is(err, ErrConfirmDenied) {
+		t.Fatalf("sign without confirmer: got %v, want ErrConfirmDenied", err)
+	}
+
+	// keys added without ConfirmBeforeUse need no confirmer
+	if _, err = a.Sign(addTestKey(t, a, "plain"), []byte("data")); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestConfirmDenied(t *testing.T) {
+	socket, upstream := testUpstream(t)
+
+	a := NewSSHAgent(context.Background(), socket, filepath.Join(t.TempDir(), "agent.sock"))
+	defer a.Close()
+
+	var asked atomic.Int32
+	a.SetConfirmer(ConfirmFunc(func(context.Context, ConfirmRequest) error {
+		asked.Add(1)
+		return ErrConfirmDenied
+	}))
+
+	for name, key := range map[string]ssh.PublicKey{
+		"local":    addTestKey(t, a, "local"),
+		"upstream": addTestKey(t, upstream, "upstream"),
+	} {
+		if _, err := a.Sign(key, []byte("data")); !errors.Is(err, ErrConfirmDenied) {
+			t.Errorf("%s key: got %v, want ErrConfirmDenied", name, err)
+		}
+	}
+	if asked.Load() != 2 {
+		t.Fatalf("confirmer asked %d times, want 2", asked.Load())
+	}
+
+	// a key held by no backend fail without prompting the user
+	unknown := addTestKey(t, agent.NewKeyring(), "unknown")
+	if _, err := a.Sign(unknown, []byte("data")); !errors.Is(err, ErrKeyNotFound) {
+		t.Fatalf("unknown key: got %v, want ErrKeyNotFound", err)
+	}
+	if asked.Load() != 2 {
+		t.Fatal("confirmer was asked for an unknown key")
+	}
+}
+
+func TestCachingConfirmer(t *testing.T) {
+	var asked atomic.Int32
+	inner := ConfirmFunc(func(context.Context, ConfirmRequest) error {
+		asked.Add(1)
+		return nil
+	})
+
+	const ttl = 50 * time.Millisecond
+	c := CachingConfirmer(inner, ttl)
+
+	peer1, peer2 := &Peer{PID: 1, UID: 1000}, &Peer{PID: 2, UID: 1000}
+	confirm := func(peer *Peer, fingerprint string, required bool) {
+		t.Helper()
+
+		req := ConfirmRequest{Fingerprint: fingerprint, Peer: peer, ConfirmRequired: required}
+		if err := c.Confirm(context.Background(), req); err != nil {
+			t.Fatal(err)
+		}
+	}
+	expect := func(want int32) {
+		t.Helper()
+
+		if got := asked.Load(); got != want {
+			t.Fatalf("inner confirmer asked %d times, want %d", got, want)
+		}
+	}
+
+	confirm(peer1, "key1", false)
+	confirm(peer1, "key1", false)
+	expect(1)
+
+	// approvals are per peer and per key
+	confirm(peer2, "key1", false)
+	confirm(peer1, "key2", false)
+	expect(3)
+
+	// requests without peer and keys added with ConfirmBeforeUse are always asked
+	confirm(nil, "key1", false)
+	confirm(nil, "key1", false)
+	confirm(peer1, "key1", true)
+	expect(6)
+
+	time.Sleep(2 * ttl)
+	confirm(peer1, "key1", false)
+	expect(7)
+}
+
+func TestCachingConfirmerDenied(t *testing.T) {
+	var asked atomic.Int32
+	c := CachingConfirmer(ConfirmFunc(func(context.Context, ConfirmRequest) error {
+		asked.Add(1)
+		return ErrConfirmDenied
+	}), time.Hour)
+
+	req := ConfirmRequest{Fingerprint: "key", Peer: &Peer{PID: 1, UID: 1000}}
+	for i := 0; i < 2; i++ {
+		if err := c.Confirm(context.Background(), req); !errors.Is(err, ErrConfirmDenied) {
+			t.Fatalf("got %v, want ErrConfirmDenied", err)
+		}
+	}
+
+	// a denial is never cached
+	if asked.Load() != 2 {
+		t.Fatalf("inner confirmer asked %d times, want 2", asked.Load())
+	}
+}
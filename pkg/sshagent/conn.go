@@ -0,0 +1,76 @@
+package sshagent
+
+import (
+	"io"
+	"net"
+	"sync"
+)
+
+// trackedConn remember the first I/O error, after which the connection is considered broken
+type trackedConn struct {
+	io.ReadWriteCloser
+
+	mu  sync.Mutex
+	err error
+	// read whether any byte was read, i.e. the peer started replying
+	read bool
+}
+
+func (c *trackedConn) Read(b []byte) (int, error) {
+	n, err := c.ReadWriteCloser.Read(b)
+	if n > 0 {
+		c.mu.Lock()
+		c.read = true
+		c.mu.Unlock()
+	}
+	c.record(err)
+	return n, err
+}
+
+func (c *trackedConn) Write(b []byte) (int, error) {
+	n, err := c.ReadWriteCloser.Write(b)
+	c.record(err)
+	return n, err
+}
+
+func (c *trackedConn) record(err error) {
+	if err == nil {
+		return
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.err == nil {
+		c.err = err
+	}
+}
+
+func (c *trackedConn) broken() bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return c.err != nil
+}
+
+// replied report whether the peer sent any byte on the connection
+func (c *trackedConn) replied() bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return c.read
+}
+
+// alive report whether an idle connection can be reused
+func (c *trackedConn) alive() bool {
+	if c.broken() {
+		return false
+	}
+
+	conn, ok := c.ReadWriteCloser.(net.Conn)
+	if !ok {
+		return true
+	}
+
+	return peerAlive(conn)
+}
@@ -0,0 +1,10 @@
+//go:build !unix
+
+package sshagent
+
+import "net"
+
+// peerAlive can not peek the connection on this platform, broken connections are detected by the retry instead
+func peerAlive(net.Conn) bool {
+	return true
+}
@@ -0,0 +1,33 @@
+//go:build unix
+
+package sshagent
+
+import (
+	"errors"
+	"net"
+	"syscall"
+)
+
+// peerAlive peek the idle connection without blocking.
+// The agent protocol never sends unsolicited data, so pending bytes or EOF both mean the connection is unusable.
+func peerAlive(conn net.Conn) bool {
+	sc, ok := conn.(syscall.Conn)
+	if !ok {
+		return true
+	}
+
+	rc, err := sc.SyscallConn()
+	if err != nil {
+		return false
+	}
+
+	alive := false
+	err = rc.Read(func(fd uintptr) bool {
+		var buf [1]byte
+		_, _, rerr := syscall.Recvfrom(int(fd), buf[:], syscall.MSG_PEEK|syscall.MSG_DONTWAIT)
+		alive = errors.Is(rerr, syscall.EAGAIN) || errors.Is(rerr, syscall.EWOULDBLOCK)
+		return true
+	})
+
+	return err == nil && alive
+}
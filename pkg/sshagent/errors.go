@@ -0,0 +1,22 @@
+package sshagent
+
+import "errors"
+
+var (
+	// ErrUpstreamUnavailable the upstream agent can not be dialed or dropped the connection
+	ErrUpstreamUnavailable = errors.New("upstream agent unavailable")
+	// ErrUpstreamTimeout the upstream agent did not answer before the deadline
+	ErrUpstreamTimeout = errors.New("upstream agent timed out")
+	// ErrKeyNotFound no upstream or local agent holds the requested key
+	ErrKeyNotFound = errors.New("key not found")
+	// ErrLocked the agent is locked, the same failure as ssh-agent
+	ErrLocked = errors.New("agent: locked")
+	// ErrIncorrectPassphrase the unlock passphrase does not match
+	ErrIncorrectPassphrase = errors.New("agent: incorrect passphrase")
+	// ErrUnlockThrottled an unlock was attempted too soon after an incorrect passphrase
+	ErrUnlockThrottled = errors.New("agent: unlock throttled")
+	// ErrIdlePassphraseRequired an IdleLock policy has no passphrase, any client could unlock the agent with an empty one
+	ErrIdlePassphraseRequired = errors.New("agent: idle lock require a passphrase")
+	// ErrConfirmDenied the sign request was not approved by the Confirmer
+	ErrConfirmDenied = errors.New("agent: confirmation denied")
+)
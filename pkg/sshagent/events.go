@@ -0,0 +1,69 @@
+package sshagent
+
+import (
+	"sync"
+	"time"
+)
+
+// EventType the kind of an agent event
+type EventType string
+
+const (
+	// EventLocked the agent was locked, by a client or by the idle policy
+	EventLocked EventType = "locked"
+	// EventUnlocked the agent was unlocked
+	EventUnlocked EventType = "unlocked"
+	// EventLocalKeysCleared the local keys were purged by the idle policy
+	EventLocalKeysCleared EventType = "local-keys-cleared"
+	// EventLocalKeysReloaded the purged local keys were reloaded on demand
+	EventLocalKeysReloaded EventType = "local-keys-reloaded"
+	// EventLocalKeysChanged the watcher loaded or unloaded key files
+	EventLocalKeysChanged EventType = "local-keys-changed"
+	// EventCertificateExpiring a local certificate expire within the policy WarnBefore
+	EventCertificateExpiring EventType = "certificate-expiring"
+	// EventCertificateExpired a local certificate expired and was dropped
+	EventCertificateExpired EventType = "certificate-expired"
+	// EventCertificateRenewed a local certificate was replaced by the renewer
+	EventCertificateRenewed EventType = "certificate-renewed"
+	// EventCertificateRenewalFailed the renewer failed to renew a local certificate
+	EventCertificateRenewalFailed EventType = "certificate-renewal-failed"
+)
+
+// Event notify a host UI about agent state changes
+type Event struct {
+	Type    EventType
+	Time    time.Time
+	Message string
+}
+
+// EventHandler receive agent events, it is called synchronously and must not block
+type EventHandler func(event Event)
+
+type eventEmitter struct {
+	mu      sync.RWMutex
+	handler EventHandler
+}
+
+// SetEventHandler set the handler receiving agent events, nil disable events
+func (s *SSHAgent) SetEventHandler(handler EventHandler) {
+	s.events.mu.Lock()
+	defer s.events.mu.Unlock()
+
+	s.events.handler = handler
+}
+
+func (s *SSHAgent) emit(t EventType, message string) {
+	s.events.mu.RLock()
+	handler := s.events.handler
+	s.events.mu.RUnlock()
+
+	if handler == nil {
+		return
+	}
+
+	handler(Event{
+		Type:    t,
+		Time:    time.Now(),
+		Message: message,
+	})
+}
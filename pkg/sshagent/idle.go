@@ -0,0 +1,155 @@
+package sshagent
+
+import (
+	"sync"
+	"time"
+)
+
+// IdleAction what the agent does after the idle timeout
+type IdleAction int
+
+const (
+	// IdleLock lock the whole agent with the policy passphrase, which must not be empty
+	IdleLock IdleAction = iota
+	// IdleClear purge all local keys, keys loaded from files are reloaded on the next request
+	IdleClear
+)
+
+// IdlePolicy protect local keys when no sign request arrived for a while
+type IdlePolicy struct {
+	// Timeout the idle duration before Action is taken, zero disable the policy
+	Timeout time.Duration
+	Action  IdleAction
+	// Passphrase unlock the agent after an IdleLock, required by IdleLock so Unlock(nil) can not unlock the agent
+	Passphrase []byte
+}
+
+type idleState struct {
+	mu     sync.Mutex
+	policy IdlePolicy
+	timer  *time.Timer
+
+	// files the key files loaded by LoadLocalKeys, reloaded after an IdleClear
+	files   []keyFile
+	cleared bool
+}
+
+// SetIdlePolicy set the idle policy, the idle timer start from now.
+// An IdleLock policy with an empty passphrase fail with ErrIdlePassphraseRequired, and the previous policy is kept.
+func (s *SSHAgent) SetIdlePolicy(policy IdlePolicy) error {
+	if policy.Timeout > 0 && policy.Action == IdleLock && len(policy.Passphrase) == 0 {
+		return ErrIdlePassphraseRequired
+	}
+
+	s.idle.mu.Lock()
+	defer s.idle.mu.Unlock()
+
+	if s.idle.timer != nil {
+		s.idle.timer.Stop()
+		s.idle.timer = nil
+	}
+
+	s.idle.policy = policy
+	if policy.Timeout > 0 {
+		s.idle.timer = time.AfterFunc(policy.Timeout, s.onIdle)
+	}
+	return nil
+}
+
+// touchIdle restart the idle timer on activity
+func (s *SSHAgent) touchIdle() {
+	s.idle.mu.Lock()
+	defer s.idle.mu.Unlock()
+
+	if s.idle.timer != nil {
+		s.idle.timer.Reset(s.idle.policy.Timeout)
+	}
+}
+
+func (s *SSHAgent) onIdle() {
+	s.idle.mu.Lock()
+	policy := s.idle.policy
+	s.idle.mu.Unlock()
+
+	switch policy.Action {
+	case IdleLock:
+		if err := s.lock.lock(policy.Passphrase); err == nil {
+			s.emit(EventLocked, "idle timeout")
+		}
+	case IdleClear:
+		if s.lock.isLocked() {
+			return
+		}
+
+		s.idle.mu.Lock()
+		s.idle.cleared = true
+		s.idle.mu.Unlock()
+
+		_ = s.forgetLocalKeys()
+		s.emit(EventLocalKeysCleared, "idle timeout")
+	}
+}
+
+// rememberLocalFile record a key file loaded by LoadLocalKeys
+func (s *SSHAgent) rememberLocalFile(file keyFile) {
+	s.idle.mu.Lock()
+	defer s.idle.mu.Unlock()
+
+	for i, f := range s.idle.files {
+		if f.path == file.path {
+			s.idle.files[i] = file
+			return
+		}
+	}
+	s.idle.files = append(s.idle.files, file)
+}
+
+// isCleared report whether the local keys were purged by the idle policy and not reloaded yet
+func (s *SSHAgent) isCleared() bool {
+	s.idle.mu.Lock()
+	defer s.idle.mu.Unlock()
+
+	return s.idle.cleared
+}
+
+// forgetLocalFile stop reloading the key file after an IdleClear, e.g. when it was deleted
+func (s *SSHAgent) forgetLocalFile(file string) {
+	s.idle.mu.Lock()
+	defer s.idle.mu.Unlock()
+
+	for i, f := range s.idle.files {
+		if f.path == file {
+			s.idle.files = append(s.idle.files[:i], s.idle.files[i+1:]...)
+			return
+		}
+	}
+}
+
+// reloadCleared reload the key files purged by IdleClear
+func (s *SSHAgent) reloadCleared() {
+	s.idle.mu.Lock()
+	if !s.idle.cleared {
+		s.idle.mu.Unlock()
+		return
+	}
+	s.idle.cleared = false
+	files := append([]keyFile(nil), s.idle.files...)
+	// the timer fired before the purge, restart it so the reloaded keys are purged again
+	if s.idle.timer != nil {
+		s.idle.timer.Reset(s.idle.policy.Timeout)
+	}
+	s.idle.mu.Unlock()
+
+	s.loadKeyFiles(files)
+	s.emit(EventLocalKeysReloaded, "")
+}
+
+func (s *SSHAgent) stopIdle() {
+	s.idle.mu.Lock()
+	defer s.idle.mu.Unlock()
+
+	if s.idle.timer != nil {
+		s.idle.timer.Stop()
+		s.idle.timer = nil
+	}
+}
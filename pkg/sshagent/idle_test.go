@@ -0,0 +1,156 @@
+package sshagent
+
+import (
+	"context"
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/pem"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/oomol-lab/ovm-ssh-agent/v3/pkg/identity"
+	"golang.org/x/crypto/ssh"
+)
+
+// writeTestKey write a new unencrypted ed25519 key file and return its public key
+func writeTestKey(t *testing.T, file string) ssh.PublicKey {
+	t.Helper()
+
+	pub, priv, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	block, err := ssh.MarshalPrivateKey(priv, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err = os.WriteFile(file, pem.EncodeToMemory(block), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	sshPub, err := ssh.NewPublicKey(pub)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return sshPub
+}
+
+func TestIdleClearAfterReload(t *testing.T) {
+	a := NewSSHAgent(context.Background(), "", filepath.Join(t.TempDir(), "agent.sock"))
+	defer a.Close()
+
+	file := filepath.Join(t.TempDir(), "id_ed25519")
+	writeTestKey(t, file)
+	a.LoadLocalKeys(file)
+
+	cleared := make(chan struct{}, 1)
+	a.SetEventHandler(func(event Event) {
+		if event.Type != EventLocalKeysCleared {
+			return
+		}
+
+		select {
+		case cleared <- struct{}{}:
+		default:
+		}
+	})
+
+	const timeout = 50 * time.Millisecond
+	a.SetIdlePolicy(IdlePolicy{Timeout: timeout, Action: IdleClear})
+
+	waitCleared := func() {
+		t.Helper()
+
+		select {
+		case <-cleared:
+		case <-time.After(20 * timeout):
+			t.Fatal("local keys were not cleared after the idle timeout")
+		}
+	}
+
+	waitCleared()
+
+	// a List alone reload the keys, which must be purged again after the timeout
+	keys, err := a.List()
+	if err != nil || len(keys) != 1 {
+		t.Fatalf("listed %d keys after reload, err %v", len(keys), err)
+	}
+
+	waitCleared()
+	if !a.isCleared() {
+		t.Fatal("reloaded keys were not purged again")
+	}
+}
+
+func TestIdleClearReloadCertificateFile(t *testing.T) {
+	a := NewSSHAgent(context.Background(), "", filepath.Join(t.TempDir(), "agent.sock"))
+	defer a.Close()
+
+	dir := t.TempDir()
+	file := filepath.Join(dir, "id_ed25519")
+	key := writeTestKey(t, file)
+	certPath := filepath.Join(dir, "user.cert")
+	cert := writeTestCertificate(t, certPath, key, "config")
+	a.LoadKeys(identity.KeyInfo{Path: file, CertificatePath: certPath})
+
+	cleared := make(chan struct{}, 1)
+	a.SetEventHandler(func(event Event) {
+		if event.Type == EventLocalKeysCleared {
+			cleared <- struct{}{}
+		}
+	})
+
+	const timeout = 50 * time.Millisecond
+	a.SetIdlePolicy(IdlePolicy{Timeout: timeout, Action: IdleClear})
+	select {
+	case <-cleared:
+	case <-time.After(20 * timeout):
+		t.Fatal("local keys were not cleared after the idle timeout")
+	}
+	a.SetIdlePolicy(IdlePolicy{})
+
+	// the reload must read the CertificateFile again, not the -cert.pub file
+	keys, err := a.List()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !containsKey(keys, cert) {
+		t.Fatalf("listed %d keys after reload, want the certificate", len(keys))
+	}
+}
+
+func TestIdleLockPassphraseRequired(t *testing.T) {
+	a := NewSSHAgent(context.Background(), "", filepath.Join(t.TempDir(), "agent.sock"))
+	defer a.Close()
+
+	const timeout = 50 * time.Millisecond
+	if err := a.SetIdlePolicy(IdlePolicy{Timeout: timeout, Action: IdleLock}); !errors.Is(err, ErrIdlePassphraseRequired) {
+		t.Fatalf("idle lock without passphrase: got %v, want ErrIdlePassphraseRequired", err)
+	}
+
+	time.Sleep(4 * timeout)
+	if a.lock.isLocked() {
+		t.Fatal("the rejected policy locked the agent")
+	}
+
+	if err := a.SetIdlePolicy(IdlePolicy{Timeout: timeout, Action: IdleLock, Passphrase: []byte("secret")}); err != nil {
+		t.Fatal(err)
+	}
+	deadline := time.Now().Add(20 * timeout)
+	for !a.lock.isLocked() {
+		if time.Now().After(deadline) {
+			t.Fatal("agent was not locked after the idle timeout")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	if err := a.Unlock(nil); err == nil {
+		t.Fatal("empty passphrase unlocked the idle lock")
+	}
+}
@@ -0,0 +1,89 @@
+package sshagent
+
+import (
+	"sync"
+
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/agent"
+)
+
+// keyOwner the backend holding a key, local agent when upstream is nil
+type keyOwner struct {
+	upstream *upstreamAgent
+}
+
+var localOwner = keyOwner{}
+
+func (o keyOwner) isLocal() bool {
+	return o.upstream == nil
+}
+
+// keyIndex map key fingerprint to the backend holding it
+type keyIndex struct {
+	mu     sync.RWMutex
+	owners map[string]keyOwner
+}
+
+func newKeyIndex() *keyIndex {
+	return &keyIndex{
+		owners: make(map[string]keyOwner),
+	}
+}
+
+func (i *keyIndex) get(key ssh.PublicKey) (keyOwner, bool) {
+	i.mu.RLock()
+	defer i.mu.RUnlock()
+
+	owner, ok := i.owners[ssh.FingerprintSHA256(key)]
+	return owner, ok
+}
+
+func (i *keyIndex) set(key ssh.PublicKey, owner keyOwner) {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+
+	i.owners[ssh.FingerprintSHA256(key)] = owner
+}
+
+func (i *keyIndex) delete(key ssh.PublicKey) {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+
+	delete(i.owners, ssh.FingerprintSHA256(key))
+}
+
+// sync replace all keys of the owner with the listed keys.
+// Keys already held by another backend keep their owner, so the first backend in order wins.
+func (i *keyIndex) sync(owner keyOwner, keys []*agent.Key) {
+	listed := make(map[string]struct{}, len(keys))
+	for _, k := range keys {
+		listed[ssh.FingerprintSHA256(k)] = struct{}{}
+	}
+
+	i.mu.Lock()
+	defer i.mu.Unlock()
+
+	for fp, o := range i.owners {
+		if _, ok := listed[fp]; !ok && o == owner {
+			delete(i.owners, fp)
+		}
+	}
+
+	for fp := range listed {
+		if _, ok := i.owners[fp]; !ok {
+			i.owners[fp] = owner
+		}
+	}
+}
+
+// removeOwner drop all keys held by the owner
+func (i *keyIndex) removeOwner(owner keyOwner) {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+
+	for fp, o := range i.owners {
+		if o == owner {
+			delete(i.owners, fp)
+		}
+	}
+}
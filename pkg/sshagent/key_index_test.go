@@ -0,0 +1,104 @@
+package sshagent
+
+import (
+	"context"
+	"crypto/ed25519"
+	"crypto/rand"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/agent"
+)
+
+// countingAgent count the List and Sign requests reaching the agent
+type countingAgent struct {
+	agent.Agent
+	lists atomic.Int32
+	signs atomic.Int32
+}
+
+func (a *countingAgent) List() ([]*agent.Key, error) {
+	a.lists.Add(1)
+	return a.Agent.List()
+}
+
+func (a *countingAgent) Sign(key ssh.PublicKey, data []byte) (*ssh.Signature, error) {
+	a.signs.Add(1)
+	return a.Agent.Sign(key, data)
+}
+
+func TestSignRoutedByIndex(t *testing.T) {
+	upstream1 := &countingAgent{Agent: agent.NewKeyring()}
+	upstream2 := &countingAgent{Agent: agent.NewKeyring()}
+	socket1, socket2 := serveTestUpstream(t, upstream1), serveTestUpstream(t, upstream2)
+
+	a := NewSSHAgentWithUpstreams(context.Background(), []string{socket1, socket2}, filepath.Join(t.TempDir(), "agent.sock"))
+	defer a.Close()
+	key := addTestKey(t, upstream2, "upstream2")
+
+	if _, err := a.List(); err != nil {
+		t.Fatal(err)
+	}
+	lists1, lists2 := upstream1.lists.Load(), upstream2.lists.Load()
+
+	signature, err := a.Sign(key, []byte("data"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = key.Verify([]byte("data"), signature); err != nil {
+		t.Fatal(err)
+	}
+
+	// the indexed owner is asked directly, without scanning the upstreams
+	if upstream1.lists.Load() != lists1 || upstream2.lists.Load() != lists2 {
+		t.Error("sign of an indexed key listed the upstreams")
+	}
+	if upstream1.signs.Load() != 0 || upstream2.signs.Load() != 1 {
+		t.Errorf("sign requests: upstream1 %d, upstream2 %d, want 0 and 1", upstream1.signs.Load(), upstream2.signs.Load())
+	}
+}
+
+func TestSignIndexMiss(t *testing.T) {
+	socket1, upstream1 := testUpstream(t)
+	socket2, upstream2 := testUpstream(t)
+
+	a := NewSSHAgentWithUpstreams(context.Background(), []string{socket1, socket2}, filepath.Join(t.TempDir(), "agent.sock"))
+	defer a.Close()
+
+	_, priv, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	signer, err := ssh.NewSignerFromKey(priv)
+	if err != nil {
+		t.Fatal(err)
+	}
+	key := signer.PublicKey()
+
+	// a key added after the last List is found by scanning the upstreams
+	if err = upstream2.Add(agent.AddedKey{PrivateKey: priv}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = a.Sign(key, []byte("data")); err != nil {
+		t.Fatalf("sign of an unindexed key: %v", err)
+	}
+	if owner, ok := a.index.get(key); !ok || owner.upstream != a.upstreamAgents[1] {
+		t.Fatal("scanned key was not indexed to its upstream")
+	}
+
+	// the key moved to another upstream, the stale index entry must not fail the sign
+	if err = upstream2.Remove(key); err != nil {
+		t.Fatal(err)
+	}
+	if err = upstream1.Add(agent.AddedKey{PrivateKey: priv}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = a.Sign(key, []byte("data")); err != nil {
+		t.Fatalf("sign of a moved key: %v", err)
+	}
+	if owner, ok := a.index.get(key); !ok || owner.upstream != a.upstreamAgents[0] {
+		t.Fatal("index still point to the old upstream")
+	}
+}
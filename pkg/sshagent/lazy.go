@@ -0,0 +1,170 @@
+package sshagent
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/oomol-lab/ovm-ssh-agent/v3/pkg/identity"
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/agent"
+)
+
+// lazyKey an encrypted key file advertised by its public key (and certificate), decrypted on first use
+type lazyKey struct {
+	// mu serialize decryption, so concurrent sign requests prompt only once
+	mu      sync.Mutex
+	file    string
+	pub     ssh.PublicKey
+	cert    *ssh.Certificate
+	comment string
+}
+
+// publicKeys return the keys the lazy key is listed with
+func (k *lazyKey) publicKeys() []ssh.PublicKey {
+	if k.cert == nil {
+		return []ssh.PublicKey{k.pub}
+	}
+
+	return []ssh.PublicKey{k.pub, k.cert}
+}
+
+type lazyKeys struct {
+	mu sync.RWMutex
+	// keys index lazy keys by the fingerprint of their key and certificate
+	keys  map[string]*lazyKey
+	order []*lazyKey
+}
+
+func (l *lazyKeys) add(k *lazyKey) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if l.keys == nil {
+		l.keys = make(map[string]*lazyKey)
+	}
+
+	if old, ok := l.keys[ssh.FingerprintSHA256(k.pub)]; ok {
+		l.remove(old)
+	}
+
+	for _, pub := range k.publicKeys() {
+		l.keys[ssh.FingerprintSHA256(pub)] = k
+	}
+	l.order = append(l.order, k)
+}
+
+func (l *lazyKeys) get(key ssh.PublicKey) (*lazyKey, bool) {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+
+	k, ok := l.keys[ssh.FingerprintSHA256(key)]
+	return k, ok
+}
+
+// delete drop the lazy key listed with the key, together with its certificate
+func (l *lazyKeys) delete(key ssh.PublicKey) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if k, ok := l.keys[ssh.FingerprintSHA256(key)]; ok {
+		l.remove(k)
+	}
+}
+
+func (l *lazyKeys) remove(k *lazyKey) {
+	for _, pub := range k.publicKeys() {
+		delete(l.keys, ssh.FingerprintSHA256(pub))
+	}
+
+	for i, o := range l.order {
+		if o == k {
+			l.order = append(l.order[:i], l.order[i+1:]...)
+			break
+		}
+	}
+}
+
+func (l *lazyKeys) clear() {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	l.keys = nil
+	l.order = nil
+}
+
+// list return the lazy keys as agent keys, in load order. Certificates expired at now are left out.
+func (l *lazyKeys) list(now time.Time) []*agent.Key {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+
+	keys := make([]*agent.Key, 0, len(l.order))
+	for _, k := range l.order {
+		for _, pub := range k.publicKeys() {
+			if cert, ok := pub.(*ssh.Certificate); ok && identity.CheckCertificateValidity(cert, now) != nil {
+				continue
+			}
+			keys = append(keys, &agent.Key{
+				Format:  pub.Type(),
+				Blob:    pub.Marshal(),
+				Comment: k.comment,
+			})
+		}
+	}
+
+	return keys
+}
+
+// decryptLazy decrypt the key file through the passphrase provider and move it into the local agent,
+// the provider is given up on when ctx is done
+func (s *SSHAgent) decryptLazy(ctx context.Context, k *lazyKey) error {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+
+	// decrypted by a concurrent request
+	if _, ok := s.lazy.get(k.pub); !ok {
+		return nil
+	}
+
+	content, err := os.ReadFile(k.file)
+	if err != nil {
+		return fmt.Errorf("failed to read key file %q: %w", k.file, err)
+	}
+
+	privateKey, err := s.decrypter.ParsePrivateKey(ctx, k.file, content)
+	if err != nil {
+		return fmt.Errorf("failed to decrypt key file %q: %w", k.file, err)
+	}
+
+	// a stale .pub file advertise another key than the one in the key file
+	signer, err := ssh.NewSignerFromKey(privateKey)
+	if err != nil {
+		return fmt.Errorf("failed to decrypt key file %q: %w", k.file, err)
+	}
+	if !bytes.Equal(signer.PublicKey().Marshal(), k.pub.Marshal()) {
+		return fmt.Errorf("key file %q holds %s, not the advertised %s", k.file, ssh.FingerprintSHA256(signer.PublicKey()), ssh.FingerprintSHA256(k.pub))
+	}
+
+	if err = s.addWithSource(agent.AddedKey{
+		PrivateKey: privateKey,
+		Comment:    k.comment,
+	}, fileSource(k.file)); err != nil {
+		return err
+	}
+
+	if k.cert != nil && identity.CheckCertificateValidity(k.cert, time.Now()) == nil {
+		if err = s.addWithSource(agent.AddedKey{
+			PrivateKey:  privateKey,
+			Certificate: k.cert,
+			Comment:     k.comment,
+		}, fileSource(k.file)); err != nil {
+			return err
+		}
+	}
+
+	s.lazy.delete(k.pub)
+	return nil
+}
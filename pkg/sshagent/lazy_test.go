@@ -0,0 +1,104 @@
+package sshagent
+
+import (
+	"context"
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/pem"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/oomol-lab/ovm-ssh-agent/v3/pkg/identity"
+	"golang.org/x/crypto/ssh"
+)
+
+// writeEncryptedTestKey write a new passphrase protected ed25519 key file and return its public key
+func writeEncryptedTestKey(t *testing.T, file string, passphrase []byte) ssh.PublicKey {
+	t.Helper()
+
+	pub, priv, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	block, err := ssh.MarshalPrivateKeyWithPassphrase(priv, "", passphrase)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err = os.WriteFile(file, pem.EncodeToMemory(block), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	sshPub, err := ssh.NewPublicKey(pub)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return sshPub
+}
+
+func testPassphrase(passphrase string) identity.PassphraseProvider {
+	return identity.PassphraseFunc(func(_ context.Context, _ string, _ int) ([]byte, error) {
+		return []byte(passphrase), nil
+	})
+}
+
+func TestLazyDecrypt(t *testing.T) {
+	a := NewSSHAgent(context.Background(), "", filepath.Join(t.TempDir(), "agent.sock"))
+	defer a.Close()
+	a.SetPassphraseProvider(testPassphrase("secret"), 1)
+
+	file := filepath.Join(t.TempDir(), "id_ed25519")
+	key := writeEncryptedTestKey(t, file, []byte("secret"))
+
+	results := a.LoadLocalKeys(file)
+	if len(results) != 1 || results[0].Status != LoadStatusDeferred {
+		t.Fatalf("load results %v, want deferred", results)
+	}
+
+	signature, err := a.Sign(key, []byte("data"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = key.Verify([]byte("data"), signature); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, ok := a.lazy.get(key); ok {
+		t.Fatal("decrypted key is still waiting for decryption")
+	}
+}
+
+func TestLazyDecryptStalePublicKey(t *testing.T) {
+	a := NewSSHAgent(context.Background(), "", filepath.Join(t.TempDir(), "agent.sock"))
+	defer a.Close()
+	a.SetPassphraseProvider(testPassphrase("secret"), 1)
+
+	dir := t.TempDir()
+	file := filepath.Join(dir, "id_ed25519")
+	actual := writeEncryptedTestKey(t, file, []byte("secret"))
+
+	// the .pub file is left over from a previous key
+	stale := writeTestKey(t, filepath.Join(dir, "old"))
+	if err := os.WriteFile(file+".pub", ssh.MarshalAuthorizedKey(stale), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	a.LoadLocalKeys(file)
+
+	_, err := a.Sign(stale, []byte("data"))
+	if err == nil || errors.Is(err, ErrKeyNotFound) {
+		t.Fatalf("sign with stale public key: got %v, want a mismatch error", err)
+	}
+
+	lks, err := a.localAgent.List()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if containsKey(lks, actual) {
+		t.Fatal("mismatching key was added to the local agent")
+	}
+}
@@ -0,0 +1,118 @@
+package sshagent
+
+import (
+	"fmt"
+	"sort"
+
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/agent"
+)
+
+// ListPolicy control how List present the keys of all backends.
+// Keys are always deduplicated by public key blob, the first backend in order wins.
+type ListPolicy struct {
+	// Label return the label appended to the key comment as "[label]", an empty label leave the comment alone.
+	// nil disable labels.
+	Label func(source KeySource) string
+	// Priority rank the keys, keys with a higher priority are listed first.
+	// Keys with the same priority keep the backend order: upstreams in order, then local keys. nil keep the backend order.
+	Priority func(key *agent.Key, source KeySource) int
+}
+
+// SetListPolicy set how List label and order the keys. Should be called before Serve.
+func (s *SSHAgent) SetListPolicy(policy ListPolicy) {
+	s.listPolicy = policy
+}
+
+// KindLabel label keys with the kind of their source, and upstream keys with the given upstream labels,
+// e.g. map[string]string{"/path/to/1password/agent.sock": "1password"}
+func KindLabel(upstreams map[string]string) func(source KeySource) string {
+	return func(source KeySource) string {
+		if source.Kind == KeySourceUpstream {
+			if label, ok := upstreams[source.Upstream]; ok {
+				return label
+			}
+		}
+
+		return string(source.Kind)
+	}
+}
+
+// PreferFingerprints rank the keys with the given SHA256 fingerprints first, in the given order
+func PreferFingerprints(fingerprints ...string) func(key *agent.Key, source KeySource) int {
+	rank := make(map[string]int, len(fingerprints))
+	for i, fp := range fingerprints {
+		rank[fp] = len(fingerprints) - i
+	}
+
+	return func(key *agent.Key, _ KeySource) int {
+		return rank[ssh.FingerprintSHA256(key)]
+	}
+}
+
+// arrangeIdentities deduplicate the listed keys, then order and label them by the list policy
+func (s *SSHAgent) arrangeIdentities(identities []Identity) []Identity {
+	identities = dedupIdentities(identities)
+
+	policy := s.listPolicy
+	if policy.Priority != nil {
+		priorities := make([]int, len(identities))
+		for i, id := range identities {
+			priorities[i] = policy.Priority(id.Key, id.Source)
+		}
+
+		sort.Stable(byPriority{identities, priorities})
+	}
+
+	if policy.Label != nil {
+		for i, id := range identities {
+			label := policy.Label(id.Source)
+			if label == "" {
+				continue
+			}
+
+			comment := fmt.Sprintf("[%s]", label)
+			if id.Comment != "" {
+				comment = fmt.Sprintf("%s [%s]", id.Comment, label)
+			}
+			identities[i].Key = &agent.Key{Format: id.Format, Blob: id.Blob, Comment: comment}
+		}
+	}
+
+	return identities
+}
+
+// byPriority sort identities by descending priority
+type byPriority struct {
+	identities []Identity
+	priorities []int
+}
+
+func (p byPriority) Len() int {
+	return len(p.identities)
+}
+
+func (p byPriority) Less(i, j int) bool {
+	return p.priorities[i] > p.priorities[j]
+}
+
+func (p byPriority) Swap(i, j int) {
+	p.identities[i], p.identities[j] = p.identities[j], p.identities[i]
+	p.priorities[i], p.priorities[j] = p.priorities[j], p.priorities[i]
+}
+
+// dedupIdentities drop keys already listed, keeping the first occurrence
+func dedupIdentities(identities []Identity) []Identity {
+	seen := make(map[string]struct{}, len(identities))
+	unique := identities[:0]
+	for _, id := range identities {
+		if _, ok := seen[string(id.Blob)]; ok {
+			continue
+		}
+
+		seen[string(id.Blob)] = struct{}{}
+		unique = append(unique, id)
+	}
+
+	return unique
+}
@@ -0,0 +1,86 @@
+package sshagent
+
+import (
+	"reflect"
+	"testing"
+
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/agent"
+)
+
+func TestArrangeIdentities(t *testing.T) {
+	upstream := KeySource{Kind: KeySourceUpstream, Upstream: "/tmp/1password.sock"}
+	other := KeySource{Kind: KeySourceUpstream, Upstream: "/tmp/other.sock"}
+	file := KeySource{Kind: KeySourceFile, File: "/home/user/.ssh/id_ed25519"}
+
+	identity := func(blob, comment string, source KeySource) Identity {
+		return Identity{Key: &agent.Key{Format: ssh.KeyAlgoED25519, Blob: []byte(blob), Comment: comment}, Source: source}
+	}
+	// the listed keys: upstreams in order, then local keys, b is held by an upstream and the local agent
+	listed := func() []Identity {
+		return []Identity{
+			identity("a", "a", upstream),
+			identity("b", "b", other),
+			identity("c", "", file),
+			identity("b", "b local", file),
+			identity("d", "d", file),
+		}
+	}
+	fingerprint := func(blob string) string {
+		return ssh.FingerprintSHA256(&agent.Key{Blob: []byte(blob)})
+	}
+
+	tests := []struct {
+		name   string
+		policy ListPolicy
+		want   []string
+	}{
+		{
+			name: "dedup keep the first backend",
+			want: []string{"a", "b", "", "d"},
+		},
+		{
+			name:   "priority",
+			policy: ListPolicy{Priority: PreferFingerprints(fingerprint("d"), fingerprint("b"))},
+			want:   []string{"d", "b", "a", ""},
+		},
+		{
+			name: "equal priority keep the backend order",
+			policy: ListPolicy{Priority: func(_ *agent.Key, source KeySource) int {
+				if source.Kind == KeySourceFile {
+					return 1
+				}
+				return 0
+			}},
+			want: []string{"", "d", "a", "b"},
+		},
+		{
+			name:   "kind label",
+			policy: ListPolicy{Label: KindLabel(map[string]string{upstream.Upstream: "1password"})},
+			want:   []string{"a [1password]", "b [upstream]", "[file]", "d [file]"},
+		},
+		{
+			name: "empty label",
+			policy: ListPolicy{Label: func(source KeySource) string {
+				if source.Kind == KeySourceFile {
+					return ""
+				}
+				return "remote"
+			}},
+			want: []string{"a [remote]", "b [remote]", "", "d"},
+		},
+	}
+
+	for _, tt := range tests {
+		a := &SSHAgent{listPolicy: tt.policy}
+
+		var got []string
+		for _, id := range a.arrangeIdentities(listed()) {
+			got = append(got, id.Comment)
+		}
+
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%s: arranged %q, want %q", tt.name, got, tt.want)
+		}
+	}
+}
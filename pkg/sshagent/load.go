@@ -0,0 +1,355 @@
+package sshagent
+
+import (
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/oomol-lab/ovm-ssh-agent/v3/pkg/identity"
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/agent"
+)
+
+// LoadStatus the outcome of loading one key file
+type LoadStatus string
+
+const (
+	// LoadStatusLoaded the key was added to the local agent
+	LoadStatusLoaded LoadStatus = "loaded"
+	// LoadStatusDeferred the key is encrypted, it is listed and decrypted on first use
+	LoadStatusDeferred LoadStatus = "deferred"
+	// LoadStatusSkippedEncrypted the key is encrypted and no passphrase decrypted it
+	LoadStatusSkippedEncrypted LoadStatus = "skipped-encrypted"
+	// LoadStatusUnsupportedType the key type is not supported
+	LoadStatusUnsupportedType LoadStatus = "unsupported-type"
+	// LoadStatusNotFound the key file does not exist
+	LoadStatusNotFound LoadStatus = "not-found"
+	// LoadStatusPermissionDenied the key file can not be read
+	LoadStatusPermissionDenied LoadStatus = "permission-denied"
+	// LoadStatusReadError the key file can not be read for another reason, e.g. it is a directory
+	LoadStatusReadError LoadStatus = "read-error"
+	// LoadStatusParseError the file is not a valid private key
+	LoadStatusParseError LoadStatus = "parse-error"
+	// LoadStatusDuplicate the key is already held by the local agent
+	LoadStatusDuplicate LoadStatus = "duplicate"
+	// LoadStatusCertificateExpired the certificate paired with the key has expired
+	LoadStatusCertificateExpired LoadStatus = "certificate-expired"
+	// LoadStatusCertificateNotYetValid the certificate paired with the key is not valid yet
+	LoadStatusCertificateNotYetValid LoadStatus = "certificate-not-yet-valid"
+	// LoadStatusInsecurePermissions the key file was refused by the permission policy
+	LoadStatusInsecurePermissions LoadStatus = "insecure-permissions"
+	// LoadStatusAddFailed the local agent refused the key, e.g. with ErrLocked while the agent is locked
+	LoadStatusAddFailed LoadStatus = "add-failed"
+)
+
+// LoadResult the outcome of loading one key file
+type LoadResult struct {
+	Path   string
+	Status LoadStatus
+	// Fingerprint the SHA256 fingerprint of the key, empty when unknown
+	Fingerprint string
+	// Err the cause of a failed load
+	Err error
+	// Permissions the permission audit findings of the key file, reported unless the policy is PermissionIgnore
+	Permissions []identity.PermissionFinding
+}
+
+func (r LoadResult) String() string {
+	if r.Err != nil {
+		return fmt.Sprintf("%s: %s: %v", r.Path, r.Status, r.Err)
+	}
+
+	if len(r.Permissions) > 0 {
+		return fmt.Sprintf("%s: %s: warning: %s", r.Path, r.Status, identity.FormatFindings(r.Permissions))
+	}
+
+	return fmt.Sprintf("%s: %s", r.Path, r.Status)
+}
+
+// SetPermissionPolicy set what LoadLocalKeys does with key files failing the permission audit,
+// the default PermissionWarn load them and report the findings. Should be called before LoadLocalKeys.
+func (s *SSHAgent) SetPermissionPolicy(policy identity.PermissionPolicy) {
+	s.permissions = policy
+}
+
+// LoadLocalKeys load local keys from files, and report the outcome of every file.
+// A valid certificate paired with a key (id_ed25519-cert.pub) is loaded too, with its own result.
+// With a passphrase provider, encrypted keys with a known public key are listed right away,
+// and only decrypted when the first sign request for them arrives.
+func (s *SSHAgent) LoadLocalKeys(keys ...string) []LoadResult {
+	files := make([]keyFile, 0, len(keys))
+	for _, key := range keys {
+		files = append(files, keyFile{path: key, certPath: identity.CertificatePath(key)})
+	}
+
+	return s.loadKeyFiles(files)
+}
+
+// LoadKeys is like LoadLocalKeys for discovered keys, the certificate is read from KeyInfo.CertificatePath,
+// e.g. a CertificateFile of ~/.ssh/config. An empty CertificatePath fall back to the -cert.pub file.
+func (s *SSHAgent) LoadKeys(keys ...identity.KeyInfo) []LoadResult {
+	return s.loadKeyFiles(keyFilesOf(keys))
+}
+
+// keyFile a private key file and the certificate loaded with it, empty when none
+type keyFile struct {
+	path     string
+	certPath string
+}
+
+func keyFilesOf(keys []identity.KeyInfo) []keyFile {
+	files := make([]keyFile, 0, len(keys))
+	for _, key := range keys {
+		certPath := key.CertificatePath
+		if certPath == "" {
+			certPath = identity.CertificatePath(key.Path)
+		}
+		files = append(files, keyFile{path: key.Path, certPath: certPath})
+	}
+
+	return files
+}
+
+func (s *SSHAgent) loadKeyFiles(files []keyFile) []LoadResult {
+	results := make([]LoadResult, 0, len(files))
+	for _, f := range files {
+		result := s.loadLocalKey(f)
+		if result[0].Status == LoadStatusLoaded || result[0].Status == LoadStatusDeferred {
+			s.rememberLocalFile(f)
+		}
+		s.recordLocalFile(f)
+
+		results = append(results, result...)
+	}
+
+	return results
+}
+
+// loadLocalKey load the key file and its certificate, the first result is the key file
+func (s *SSHAgent) loadLocalKey(f keyFile) []LoadResult {
+	file, certPath := f.path, f.certPath
+
+	result, key := s.loadPrivateKey(file, certPath)
+	if certPath == "" {
+		return []LoadResult{result}
+	}
+
+	switch result.Status {
+	case LoadStatusLoaded, LoadStatusDuplicate:
+		return []LoadResult{result, s.loadCertificate(file, certPath, key)}
+	case LoadStatusDeferred:
+		_, certResult := readCertificate(certPath, result.Fingerprint)
+		if certResult.Status == "" {
+			certResult.Status = LoadStatusDeferred
+		}
+		return []LoadResult{result, certResult}
+	default:
+		return []LoadResult{result}
+	}
+}
+
+// loadPrivateKey add the key file to the local agent, and return the key when it is held by the local agent
+func (s *SSHAgent) loadPrivateKey(file, certPath string) (LoadResult, agent.AddedKey) {
+	result := LoadResult{Path: file}
+
+	r, err := os.ReadFile(file)
+	if err != nil {
+		result.Status = readErrorStatus(err)
+		result.Err = err
+		return result, agent.AddedKey{}
+	}
+
+	if s.permissions != identity.PermissionIgnore {
+		result.Permissions = identity.AuditKeyFile(file)
+	}
+	if s.permissions == identity.PermissionRefuse && len(result.Permissions) > 0 {
+		result.Status = LoadStatusInsecurePermissions
+		result.Err = fmt.Errorf("%w: %s", identity.ErrInsecurePermissions, identity.FormatFindings(result.Permissions))
+		return result, agent.AddedKey{}
+	}
+
+	if pub, ok := s.deferEncrypted(file, certPath, r); ok {
+		result.Fingerprint = ssh.FingerprintSHA256(pub)
+		result.Status = LoadStatusDeferred
+		return result, agent.AddedKey{}
+	}
+
+	privateKey, err := s.decrypter.ParsePrivateKey(s.context, file, r)
+	if err != nil {
+		result.Status = classifyParseError(err)
+		result.Err = err
+		return result, agent.AddedKey{}
+	}
+
+	signer, err := ssh.NewSignerFromKey(privateKey)
+	if err != nil {
+		result.Status = LoadStatusUnsupportedType
+		result.Err = err
+		return result, agent.AddedKey{}
+	}
+	result.Fingerprint = ssh.FingerprintSHA256(signer.PublicKey())
+
+	key := agent.AddedKey{
+		PrivateKey: privateKey,
+		Comment:    identity.KeyComment(file, r),
+	}
+
+	if s.holdsLocalKey(signer.PublicKey()) {
+		result.Status = LoadStatusDuplicate
+		return result, key
+	}
+
+	if err = s.addWithSource(key, fileSource(file)); err != nil {
+		result.Status = LoadStatusAddFailed
+		result.Err = fmt.Errorf("failed to add key: %w", err)
+		return result, agent.AddedKey{}
+	}
+
+	result.Status = LoadStatusLoaded
+	return result, key
+}
+
+// loadCertificate add the certificate paired with a private key loaded from file
+func (s *SSHAgent) loadCertificate(file, certPath string, key agent.AddedKey) LoadResult {
+	signer, err := ssh.NewSignerFromKey(key.PrivateKey)
+	if err != nil {
+		return LoadResult{Path: certPath, Status: LoadStatusUnsupportedType, Err: err}
+	}
+
+	cert, result := readCertificate(certPath, ssh.FingerprintSHA256(signer.PublicKey()))
+	if cert == nil {
+		return result
+	}
+
+	if s.holdsLocalKey(cert) {
+		result.Status = LoadStatusDuplicate
+		return result
+	}
+
+	key.Certificate = cert
+	if err = s.addWithSource(key, fileSource(file)); err != nil {
+		result.Status = LoadStatusAddFailed
+		result.Err = fmt.Errorf("failed to add certificate: %w", err)
+		return result
+	}
+	s.trackCertificate(key, certPath)
+
+	result.Status = LoadStatusLoaded
+	return result
+}
+
+// readCertificate read a certificate for the key with the given fingerprint.
+// A nil certificate come with a result reporting why it can not be used, otherwise the status is left empty.
+func readCertificate(certPath, keyFingerprint string) (*ssh.Certificate, LoadResult) {
+	result := LoadResult{Path: certPath}
+
+	cert, err := identity.ReadCertificate(certPath)
+	if err != nil {
+		result.Status = LoadStatusParseError
+		var pathErr *fs.PathError
+		if errors.As(err, &pathErr) {
+			result.Status = readErrorStatus(err)
+		}
+		result.Err = err
+		return nil, result
+	}
+	result.Fingerprint = ssh.FingerprintSHA256(cert)
+
+	if ssh.FingerprintSHA256(cert.Key) != keyFingerprint {
+		result.Status = LoadStatusParseError
+		result.Err = fmt.Errorf("certificate does not match key %s", keyFingerprint)
+		return nil, result
+	}
+
+	if err = identity.CheckCertificateValidity(cert, time.Now()); err != nil {
+		result.Status = LoadStatusCertificateExpired
+		if errors.Is(err, identity.ErrCertificateNotYetValid) {
+			result.Status = LoadStatusCertificateNotYetValid
+		}
+		result.Err = err
+		return nil, result
+	}
+
+	return cert, result
+}
+
+// deferEncrypted register an encrypted key file for lazy decryption, and return its public key when it did
+func (s *SSHAgent) deferEncrypted(file, certPath string, content []byte) (ssh.PublicKey, bool) {
+	if s.decrypter == nil {
+		return nil, false
+	}
+
+	var missing *ssh.PassphraseMissingError
+	if _, err := identity.ParseRawPrivateKey(content); !errors.As(err, &missing) {
+		return nil, false
+	}
+
+	pub, comment, err := identity.PublicKey(file, content)
+	if err != nil {
+		return nil, false
+	}
+
+	var cert *ssh.Certificate
+	if certPath != "" {
+		cert, _ = readCertificate(certPath, ssh.FingerprintSHA256(pub))
+	}
+
+	if !s.holdsLocalKey(pub) {
+		k := &lazyKey{
+			file:    file,
+			pub:     pub,
+			cert:    cert,
+			comment: comment,
+		}
+		s.lazy.add(k)
+		for _, pub := range k.publicKeys() {
+			s.setSource(pub, fileSource(file))
+		}
+	}
+	return pub, true
+}
+
+// holdsLocalKey report whether the key is already in the local agent or waiting for lazy decryption
+func (s *SSHAgent) holdsLocalKey(key ssh.PublicKey) bool {
+	if _, ok := s.lazy.get(key); ok {
+		return true
+	}
+
+	lks, err := s.localAgent.List()
+	if err != nil {
+		return false
+	}
+
+	return containsKey(lks, key)
+}
+
+// readErrorStatus classify the error of reading a key or certificate file
+func readErrorStatus(err error) LoadStatus {
+	switch {
+	case errors.Is(err, fs.ErrNotExist):
+		return LoadStatusNotFound
+	case errors.Is(err, fs.ErrPermission):
+		return LoadStatusPermissionDenied
+	default:
+		return LoadStatusReadError
+	}
+}
+
+func classifyParseError(err error) LoadStatus {
+	var missing *ssh.PassphraseMissingError
+	if errors.As(err, &missing) || errors.Is(err, identity.ErrPassphraseUnavailable) || errors.Is(err, x509.IncorrectPasswordError) {
+		return LoadStatusSkippedEncrypted
+	}
+
+	for _, unsupported := range []string{"unsupported key type", "unhandled key type", "unhandled elliptic curve", "unknown key algorithm", "only P-256"} {
+		if strings.Contains(err.Error(), unsupported) {
+			return LoadStatusUnsupportedType
+		}
+	}
+
+	return LoadStatusParseError
+}
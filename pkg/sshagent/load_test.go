@@ -0,0 +1,147 @@
+package sshagent
+
+import (
+	"context"
+	"crypto/ed25519"
+	"crypto/rand"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/oomol-lab/ovm-ssh-agent/v3/pkg/identity"
+	"golang.org/x/crypto/ssh"
+)
+
+func TestLoadLocalKeysReport(t *testing.T) {
+	a := NewSSHAgent(context.Background(), "", filepath.Join(t.TempDir(), "agent.sock"))
+	defer a.Close()
+
+	dir := t.TempDir()
+	file := filepath.Join(dir, "id_ed25519")
+	writeTestKey(t, file)
+
+	tests := []struct {
+		file string
+		want LoadStatus
+	}{
+		{file, LoadStatusLoaded},
+		{file, LoadStatusDuplicate},
+		{filepath.Join(dir, "missing"), LoadStatusNotFound},
+		{dir, LoadStatusReadError},
+	}
+	for _, tt := range tests {
+		results := a.LoadLocalKeys(tt.file)
+		if len(results) != 1 || results[0].Status != tt.want {
+			t.Errorf("load %q: got %v, want %s", tt.file, results, tt.want)
+		}
+	}
+}
+
+func TestLoadLocalKeysLocked(t *testing.T) {
+	a := NewSSHAgent(context.Background(), "", filepath.Join(t.TempDir(), "agent.sock"))
+	defer a.Close()
+
+	file := filepath.Join(t.TempDir(), "id_ed25519")
+	writeTestKey(t, file)
+
+	if err := a.Lock([]byte("secret")); err != nil {
+		t.Fatal(err)
+	}
+
+	results := a.LoadLocalKeys(file)
+	if len(results) != 1 || results[0].Status != LoadStatusAddFailed || !errors.Is(results[0].Err, ErrLocked) {
+		t.Fatalf("load into locked agent: got %v, want %s wrapping ErrLocked", results, LoadStatusAddFailed)
+	}
+}
+
+// writeTestCertificate write a user certificate of the key, signed by a new CA
+func writeTestCertificate(t *testing.T, file string, key ssh.PublicKey, keyID string) *ssh.Certificate {
+	t.Helper()
+
+	_, caKey, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ca, err := ssh.NewSignerFromKey(caKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cert := &ssh.Certificate{Key: key, KeyId: keyID, CertType: ssh.UserCert, ValidBefore: ssh.CertTimeInfinity}
+	if err = cert.SignCert(rand.Reader, ca); err != nil {
+		t.Fatal(err)
+	}
+
+	if err = os.WriteFile(file, ssh.MarshalAuthorizedKey(cert), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	return cert
+}
+
+func TestLoadKeysCertificateFile(t *testing.T) {
+	a := NewSSHAgent(context.Background(), "", filepath.Join(t.TempDir(), "agent.sock"))
+	defer a.Close()
+
+	dir := t.TempDir()
+	file := filepath.Join(dir, "id_ed25519")
+	key := writeTestKey(t, file)
+
+	// a CertificateFile of ssh_config, not named after the key
+	certPath := filepath.Join(dir, "user.cert")
+	cert := writeTestCertificate(t, certPath, key, "first")
+
+	results := a.LoadKeys(identity.KeyInfo{Path: file, CertificatePath: certPath})
+	if len(results) != 2 || results[0].Status != LoadStatusLoaded || results[1].Status != LoadStatusLoaded {
+		t.Fatalf("load results %v, want key and certificate loaded", results)
+	}
+
+	lks, err := a.localAgent.List()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !containsKey(lks, cert) {
+		t.Fatal("certificate is not held by the local agent")
+	}
+
+	discovered := []keyFile{{path: file, certPath: certPath}}
+	if loaded, unloaded := a.syncLocalFiles(discovered); loaded != 0 || unloaded != 0 {
+		t.Fatalf("unchanged files: %d loaded, %d unloaded", loaded, unloaded)
+	}
+
+	// the watcher must notice the renewed certificate
+	time.Sleep(10 * time.Millisecond)
+	renewed := writeTestCertificate(t, certPath, key, "renewed")
+	if loaded, unloaded := a.syncLocalFiles(discovered); loaded != 1 || unloaded != 1 {
+		t.Fatalf("renewed certificate: %d loaded, %d unloaded, want 1 and 1", loaded, unloaded)
+	}
+
+	if lks, err = a.localAgent.List(); err != nil {
+		t.Fatal(err)
+	}
+	if containsKey(lks, cert) || !containsKey(lks, renewed) {
+		t.Fatal("renewed certificate did not replace the old one")
+	}
+}
+
+func TestLoadKeysInsecurePermissions(t *testing.T) {
+	a := NewSSHAgent(context.Background(), "", filepath.Join(t.TempDir(), "agent.sock"))
+	defer a.Close()
+	a.SetPermissionPolicy(identity.PermissionRefuse)
+
+	file := filepath.Join(t.TempDir(), "id_ed25519")
+	writeTestKey(t, file)
+	if err := os.Chmod(file, 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	results := a.LoadKeys(identity.KeyInfo{Path: file})
+	if len(results) != 1 || results[0].Status != LoadStatusInsecurePermissions || len(results[0].Permissions) == 0 {
+		t.Fatalf("load results %v, want %s with the findings", results, LoadStatusInsecurePermissions)
+	}
+	if !errors.Is(results[0].Err, identity.ErrInsecurePermissions) {
+		t.Fatalf("load error %v, want ErrInsecurePermissions", results[0].Err)
+	}
+}
@@ -0,0 +1,132 @@
+package sshagent
+
+import (
+	"os"
+	"sync"
+	"time"
+
+	"github.com/oomol-lab/ovm-ssh-agent/v3/pkg/identity"
+)
+
+// fileStamp detect changes of a file without reading it
+type fileStamp struct {
+	exists  bool
+	size    int64
+	modTime time.Time
+}
+
+func stampOf(path string) fileStamp {
+	fi, err := os.Stat(path)
+	if err != nil {
+		return fileStamp{}
+	}
+
+	return fileStamp{exists: true, size: fi.Size(), modTime: fi.ModTime()}
+}
+
+// localFile a key file passed to LoadLocalKeys
+type localFile struct {
+	certPath string
+	key      fileStamp
+	cert     fileStamp
+}
+
+// stampedCertPath the certificate file whose changes are tracked, the -cert.pub file for keys loaded without certificate
+func stampedCertPath(f keyFile) string {
+	if f.certPath != "" {
+		return f.certPath
+	}
+
+	return f.path + "-cert.pub"
+}
+
+// changed report whether the key file or its certificate changed since it was loaded
+func (f *localFile) changed(file keyFile) bool {
+	return file.certPath != f.certPath || stampOf(file.path) != f.key || stampOf(stampedCertPath(file)) != f.cert
+}
+
+type localFiles struct {
+	mu    sync.Mutex
+	files map[string]*localFile
+}
+
+// recordLocalFile remember the key file, failed files are remembered too so they are retried only when changed.
+// Missing files are not remembered, they were never loaded so there is nothing to unload.
+func (s *SSHAgent) recordLocalFile(file keyFile) {
+	f := &localFile{
+		certPath: file.certPath,
+		key:      stampOf(file.path),
+		cert:     stampOf(stampedCertPath(file)),
+	}
+	if !f.key.exists {
+		return
+	}
+
+	s.files.mu.Lock()
+	defer s.files.mu.Unlock()
+
+	if s.files.files == nil {
+		s.files.files = make(map[string]*localFile)
+	}
+	s.files.files[file.path] = f
+}
+
+// unloadLocalFile remove the keys loaded from the key file, keys added by clients are kept
+func (s *SSHAgent) unloadLocalFile(file string) {
+	s.files.mu.Lock()
+	delete(s.files.files, file)
+	s.files.mu.Unlock()
+
+	s.forgetLocalFile(file)
+	s.removeBySource(func(source KeySource) bool {
+		return source.Kind == KeySourceFile && source.File == file
+	})
+}
+
+// syncLocalFiles unload the deleted key files, reload the changed ones and load the newly discovered ones.
+// Key files loaded explicitly, e.g. by LoadLocalKeys, are kept while they exist even when they are not discovered.
+// It return the number of loaded and unloaded files.
+func (s *SSHAgent) syncLocalFiles(discovered []keyFile) (loaded, unloaded int) {
+	wanted := make(map[string]keyFile, len(discovered))
+	for _, file := range discovered {
+		wanted[file.path] = file
+	}
+
+	var stale []string
+	var load []keyFile
+
+	s.files.mu.Lock()
+	for file, f := range s.files.files {
+		want, ok := wanted[file]
+		if !ok {
+			want = keyFile{path: file, certPath: f.certPath}
+			if want.certPath == "" {
+				want.certPath = identity.CertificatePath(file)
+			}
+		}
+
+		switch {
+		case !stampOf(file).exists:
+			stale = append(stale, file)
+		case f.changed(want):
+			stale = append(stale, file)
+			load = append(load, want)
+		}
+	}
+	for _, file := range discovered {
+		if _, ok := s.files.files[file.path]; !ok {
+			load = append(load, file)
+		}
+	}
+	s.files.mu.Unlock()
+
+	for _, file := range stale {
+		s.unloadLocalFile(file)
+	}
+
+	if len(load) > 0 {
+		s.loadKeyFiles(load)
+	}
+
+	return len(load), len(stale)
+}
@@ -0,0 +1,82 @@
+package sshagent
+
+import (
+	"crypto/subtle"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+)
+
+const (
+	// unlockBaseDelay the delay after the first incorrect passphrase, doubled on every further failure
+	unlockBaseDelay = 250 * time.Millisecond
+	// unlockMaxDelay the upper bound of the unlock delay
+	unlockMaxDelay = 30 * time.Second
+)
+
+// proxyLock lock the whole proxy, upstream keys included.
+// Incorrect passphrases back off exponentially to resist brute force from a compromised client.
+type proxyLock struct {
+	mu         sync.Mutex
+	locked     bool
+	passphrase []byte
+	failures   int
+	retryAt    time.Time
+}
+
+func (l *proxyLock) isLocked() bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	return l.locked
+}
+
+func (l *proxyLock) lock(passphrase []byte) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if l.locked {
+		return ErrLocked
+	}
+
+	l.locked = true
+	l.passphrase = append([]byte(nil), passphrase...)
+	l.failures = 0
+	l.retryAt = time.Time{}
+	return nil
+}
+
+func (l *proxyLock) unlock(passphrase []byte) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if !l.locked {
+		return errors.New("agent: not locked")
+	}
+
+	if wait := time.Until(l.retryAt); wait > 0 {
+		return fmt.Errorf("%w: retry in %s", ErrUnlockThrottled, wait.Round(time.Millisecond))
+	}
+
+	if subtle.ConstantTimeCompare(passphrase, l.passphrase) != 1 {
+		l.failures++
+		l.retryAt = time.Now().Add(unlockDelay(l.failures))
+		return ErrIncorrectPassphrase
+	}
+
+	l.locked = false
+	l.passphrase = nil
+	l.failures = 0
+	l.retryAt = time.Time{}
+	return nil
+}
+
+func unlockDelay(failures int) time.Duration {
+	delay := unlockBaseDelay
+	for i := 1; i < failures && delay < unlockMaxDelay; i++ {
+		delay *= 2
+	}
+
+	return min(delay, unlockMaxDelay)
+}
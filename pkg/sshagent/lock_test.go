@@ -0,0 +1,119 @@
+package sshagent
+
+import (
+	"context"
+	"errors"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestUnlockThrottle(t *testing.T) {
+	var l proxyLock
+	if err := l.lock([]byte("secret")); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := l.unlock([]byte("wrong")); !errors.Is(err, ErrIncorrectPassphrase) {
+		t.Fatalf("unlock with wrong passphrase: got %v, want ErrIncorrectPassphrase", err)
+	}
+
+	// even the correct passphrase is refused until the delay elapsed
+	if err := l.unlock([]byte("secret")); !errors.Is(err, ErrUnlockThrottled) {
+		t.Fatalf("unlock while throttled: got %v, want ErrUnlockThrottled", err)
+	}
+	if !l.isLocked() {
+		t.Fatal("throttled unlock must keep the agent locked")
+	}
+
+	l.retryAt = time.Now()
+	if err := l.unlock([]byte("wrong")); !errors.Is(err, ErrIncorrectPassphrase) {
+		t.Fatalf("second wrong unlock: got %v, want ErrIncorrectPassphrase", err)
+	}
+	if wait := time.Until(l.retryAt); wait <= unlockBaseDelay {
+		t.Fatalf("second failure delay %s, want more than %s", wait, unlockBaseDelay)
+	}
+
+	l.retryAt = time.Now()
+	if err := l.unlock([]byte("secret")); err != nil {
+		t.Fatalf("unlock after the delay: %v", err)
+	}
+	if l.isLocked() {
+		t.Fatal("agent still locked after unlock")
+	}
+
+	// a new lock starts without the previous failures
+	if err := l.lock([]byte("other")); err != nil {
+		t.Fatal(err)
+	}
+	if err := l.unlock([]byte("other")); err != nil {
+		t.Fatalf("unlock after relock: %v", err)
+	}
+}
+
+func TestUnlockDelay(t *testing.T) {
+	if d := unlockDelay(1); d != unlockBaseDelay {
+		t.Errorf("first failure delay %s, want %s", d, unlockBaseDelay)
+	}
+
+	for failures := 2; failures < 10; failures++ {
+		if prev, d := unlockDelay(failures-1), unlockDelay(failures); d != min(2*prev, unlockMaxDelay) {
+			t.Errorf("failure %d delay %s, want double of %s", failures, d, prev)
+		}
+	}
+
+	if d := unlockDelay(1000); d != unlockMaxDelay {
+		t.Errorf("delay after many failures %s, want %s", d, unlockMaxDelay)
+	}
+}
+
+func TestLockGatesUpstreamKeys(t *testing.T) {
+	socket, upstream := testUpstream(t)
+
+	a := NewSSHAgent(context.Background(), socket, filepath.Join(t.TempDir(), "agent.sock"))
+	defer a.Close()
+
+	key := addTestKey(t, upstream, "upstream")
+	addTestKey(t, a, "local")
+
+	if err := a.Lock([]byte("secret")); err != nil {
+		t.Fatal(err)
+	}
+
+	keys, err := a.List()
+	if err != nil || len(keys) != 0 {
+		t.Fatalf("locked agent listed %d keys, err %v", len(keys), err)
+	}
+
+	if _, err = a.Sign(key, []byte("data")); !errors.Is(err, ErrLocked) {
+		t.Fatalf("locked agent sign: got %v, want ErrLocked", err)
+	}
+
+	if err = a.Unlock([]byte("wrong")); !errors.Is(err, ErrIncorrectPassphrase) {
+		t.Fatalf("unlock with wrong passphrase: got %v, want ErrIncorrectPassphrase", err)
+	}
+	if err = a.Unlock([]byte("secret")); !errors.Is(err, ErrUnlockThrottled) {
+		t.Fatalf("unlock while throttled: got %v, want ErrUnlockThrottled", err)
+	}
+
+	a.lock.mu.Lock()
+	a.lock.retryAt = time.Now()
+	a.lock.mu.Unlock()
+
+	if err = a.Unlock([]byte("secret")); err != nil {
+		t.Fatal(err)
+	}
+
+	keys, err = a.List()
+	if err != nil || len(keys) != 2 {
+		t.Fatalf("unlocked agent listed %d keys, err %v", len(keys), err)
+	}
+
+	signature, err := a.Sign(key, []byte("data"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = key.Verify([]byte("data"), signature); err != nil {
+		t.Fatal(err)
+	}
+}
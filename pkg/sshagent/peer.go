@@ -0,0 +1,98 @@
+package sshagent
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/agent"
+)
+
+// Peer the process connected to the agent socket
+type Peer struct {
+	// PID the peer process id, zero when unknown
+	PID int
+	// UID the peer user id, -1 when unknown
+	UID int
+}
+
+func (p Peer) String() string {
+	return fmt.Sprintf("pid=%d uid=%d", p.PID, p.UID)
+}
+
+type peerContextKey struct{}
+
+// WithPeer return a context carrying the peer, so in-process calls can identify their caller
+func WithPeer(ctx context.Context, peer Peer) context.Context {
+	return context.WithValue(ctx, peerContextKey{}, peer)
+}
+
+// PeerFromContext return the peer carried by ctx
+func PeerFromContext(ctx context.Context) (Peer, bool) {
+	peer, ok := ctx.Value(peerContextKey{}).(Peer)
+	return peer, ok
+}
+
+// peerOf look up the credentials of the process on the other side of a unix socket,
+// and report whether they could be resolved
+func peerOf(conn net.Conn) (peer Peer, ok bool) {
+	uc, isUnix := conn.(*net.UnixConn)
+	if !isUnix {
+		return Peer{UID: -1}, false
+	}
+
+	rc, err := uc.SyscallConn()
+	if err != nil {
+		return Peer{UID: -1}, false
+	}
+
+	peer = Peer{UID: -1}
+	_ = rc.Control(func(fd uintptr) {
+		peer, ok = peerCredentials(fd)
+	})
+
+	return peer, ok
+}
+
+// peerAgent serve one client connection, tagging requests with the client peer
+type peerAgent struct {
+	*SSHAgent
+	ctx context.Context
+}
+
+// forPeer serve a client, unresolved credentials attach no peer so they are never mistaken for one client
+func (s *SSHAgent) forPeer(peer Peer, resolved bool) agent.ExtendedAgent {
+	ctx := s.context
+	if resolved {
+		ctx = WithPeer(ctx, peer)
+	}
+
+	return &peerAgent{
+		SSHAgent: s,
+		ctx:      ctx,
+	}
+}
+
+// Add record the client peer as the source of the key
+func (p *peerAgent) Add(key agent.AddedKey) error {
+	source := KeySource{Kind: KeySourceClient, Added: time.Now()}
+	if peer, ok := PeerFromContext(p.ctx); ok {
+		source.Peer = &peer
+	}
+
+	return p.addWithSource(key, source)
+}
+
+func (p *peerAgent) List() ([]*agent.Key, error) {
+	return p.ListContext(p.ctx)
+}
+
+func (p *peerAgent) Sign(key ssh.PublicKey, data []byte) (*ssh.Signature, error) {
+	return p.SignWithFlagsContext(p.ctx, key, data, 0)
+}
+
+func (p *peerAgent) SignWithFlags(key ssh.PublicKey, data []byte, flags agent.SignatureFlags) (*ssh.Signature, error) {
+	return p.SignWithFlagsContext(p.ctx, key, data, flags)
+}
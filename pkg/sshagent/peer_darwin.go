@@ -0,0 +1,21 @@
+package sshagent
+
+import "syscall"
+
+const (
+	solLocal     = 0x0
+	localPeerPID = 0x2
+)
+
+// peerCredentials only look up the pid, the uid needs LOCAL_PEERCRED which syscall does not expose
+func peerCredentials(fd uintptr) (Peer, bool) {
+	pid, err := syscall.GetsockoptInt(int(fd), solLocal, localPeerPID)
+	if err != nil || pid == 0 {
+		return Peer{UID: -1}, false
+	}
+
+	return Peer{
+		PID: pid,
+		UID: -1,
+	}, true
+}
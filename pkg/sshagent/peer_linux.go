@@ -0,0 +1,15 @@
+package sshagent
+
+import "syscall"
+
+func peerCredentials(fd uintptr) (Peer, bool) {
+	cred, err := syscall.GetsockoptUcred(int(fd), syscall.SOL_SOCKET, syscall.SO_PEERCRED)
+	if err != nil {
+		return Peer{UID: -1}, false
+	}
+
+	return Peer{
+		PID: int(cred.Pid),
+		UID: int(cred.Uid),
+	}, true
+}
@@ -0,0 +1,7 @@
+//go:build !linux && !darwin
+
+package sshagent
+
+func peerCredentials(uintptr) (Peer, bool) {
+	return Peer{UID: -1}, false
+}
@@ -0,0 +1,68 @@
+package sshagent
+
+import (
+	"context"
+	"net"
+	"os"
+	"path/filepath"
+	"runtime"
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/ssh/agent"
+)
+
+// recordConfirmer approve every request and record the peers asking
+type recordConfirmer struct {
+	peers []*Peer
+}
+
+func (c *recordConfirmer) Confirm(_ context.Context, req ConfirmRequest) error {
+	c.peers = append(c.peers, req.Peer)
+	return nil
+}
+
+func TestSignPeer(t *testing.T) {
+	if runtime.GOOS != "linux" && runtime.GOOS != "darwin" {
+		t.Skip("peer credentials are not supported")
+	}
+
+	a := NewSSHAgent(context.Background(), "", filepath.Join(t.TempDir(), "agent.sock"))
+	key := addTestKey(t, a, "local")
+	confirmer := &recordConfirmer{}
+	a.SetConfirmer(confirmer)
+	socket := serveTestAgent(t, a)
+
+	conn, err := net.Dial("unix", socket)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	if _, err = agent.NewClient(conn).Sign(key, []byte("data")); err != nil {
+		t.Fatal(err)
+	}
+	if len(confirmer.peers) != 1 || confirmer.peers[0] == nil || confirmer.peers[0].PID != os.Getpid() {
+		t.Fatalf("confirmed peers %v, want this process", confirmer.peers)
+	}
+}
+
+func TestSignUnresolvedPeer(t *testing.T) {
+	a := NewSSHAgent(context.Background(), "", filepath.Join(t.TempDir(), "agent.sock"))
+	defer a.Close()
+	key := addTestKey(t, a, "local")
+
+	inner := &recordConfirmer{}
+	a.SetConfirmer(CachingConfirmer(inner, time.Hour))
+
+	// two clients whose credentials could not be resolved must not share an approval
+	for i := 0; i < 2; i++ {
+		if _, err := a.forPeer(Peer{UID: -1}, false).Sign(key, []byte("data")); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if len(inner.peers) != 2 || inner.peers[0] != nil || inner.peers[1] != nil {
+		t.Fatalf("confirmed peers %v, want two requests without peer", inner.peers)
+	}
+}
@@ -0,0 +1,57 @@
+package sshagent
+
+import (
+	"time"
+)
+
+// rediscoverInterval the minimum interval between two resolver runs for the same upstream
+const rediscoverInterval = 2 * time.Second
+
+// UpstreamResolver return the current upstream socket path, empty when none is found.
+// system.GetSSHAgent is a ready-made resolver.
+type UpstreamResolver func() string
+
+// SetUpstreamResolver enable upstream rediscovery. When an upstream can not be dialed,
+// the resolver is run and a new socket path replaces the dead one without dropping client connections.
+// Should be called before Serve, nil disable rediscovery.
+func (s *SSHAgent) SetUpstreamResolver(resolver UpstreamResolver) {
+	s.resolveMu.Lock()
+	defer s.resolveMu.Unlock()
+
+	s.resolver = resolver
+}
+
+// rediscover run the resolver for a dead upstream, and report whether its socket was swapped
+func (s *SSHAgent) rediscover(u *upstreamAgent) bool {
+	s.resolveMu.Lock()
+	defer s.resolveMu.Unlock()
+
+	if s.resolver == nil {
+		return false
+	}
+
+	if time.Since(s.lastResolve[u]) < rediscoverInterval {
+		return false
+	}
+	s.lastResolve[u] = time.Now()
+
+	// only unix socket upstreams are rediscovered
+	if _, ok := u.current().(*unixUpstream); !ok {
+		return false
+	}
+
+	socket := s.resolver()
+	if socket == "" {
+		return false
+	}
+
+	// never point two upstreams to the same agent
+	for _, other := range s.upstreamAgents {
+		if unix, ok := other.current().(*unixUpstream); ok && unix.socket == socket {
+			return false
+		}
+	}
+
+	u.setUpstream(UnixUpstream(socket))
+	return true
+}
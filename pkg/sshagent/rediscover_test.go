@@ -0,0 +1,34 @@
+package sshagent
+
+import (
+	"context"
+	"path/filepath"
+	"testing"
+)
+
+func TestResolveEmptyUpstream(t *testing.T) {
+	a := NewSSHAgent(context.Background(), "", filepath.Join(t.TempDir(), "agent.sock"))
+	defer a.Close()
+	a.SetStrict(true)
+
+	// no agent was found at startup, the placeholder is skipped even in strict mode
+	keys, err := a.List()
+	if err != nil || len(keys) != 0 {
+		t.Fatalf("list without upstream: %d keys, err %v", len(keys), err)
+	}
+
+	socket, upstream := testUpstream(t)
+	key := addTestKey(t, upstream, "upstream")
+	a.SetUpstreamResolver(func() string { return socket })
+
+	keys, err = a.List()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !containsKey(keys, key) {
+		t.Fatal("the resolved upstream was not listed")
+	}
+	if status := a.UpstreamStatus(); len(status) != 1 || status[0].Socket != socket {
+		t.Fatalf("upstream status %+v, want the resolved socket", status)
+	}
+}
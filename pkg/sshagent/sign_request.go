@@ -0,0 +1,117 @@
+package sshagent
+
+import (
+	"bytes"
+	"encoding/binary"
+)
+
+// SignRequestKind the kind of data a client asks to sign
+type SignRequestKind string
+
+const (
+	// SignRequestUserAuth an ssh public key authentication
+	SignRequestUserAuth SignRequestKind = "userauth"
+	// SignRequestSSHSig an ssh-keygen -Y sign signature, e.g. a git commit
+	SignRequestSSHSig SignRequestKind = "sshsig"
+	// SignRequestUnknown data in any other format
+	SignRequestUnknown SignRequestKind = "unknown"
+)
+
+// SignRequest the decoded data of a sign request
+type SignRequest struct {
+	Kind SignRequestKind
+	// User Service Algorithm SessionID are set for SignRequestUserAuth
+	User      string
+	Service   string
+	Algorithm string
+	SessionID []byte
+	// Namespace HashAlgorithm are set for SignRequestSSHSig
+	Namespace     string
+	HashAlgorithm string
+}
+
+const msgUserAuthRequest = 50
+
+var sshSigMagic = []byte("SSHSIG")
+
+// decodeSignRequest decode the data, best effort
+func decodeSignRequest(data []byte) SignRequest {
+	if req, ok := decodeUserAuth(data); ok {
+		return req
+	}
+
+	if req, ok := decodeSSHSig(data); ok {
+		return req
+	}
+
+	return SignRequest{Kind: SignRequestUnknown}
+}
+
+func decodeUserAuth(data []byte) (SignRequest, bool) {
+	r := wireReader(data)
+
+	sessionID, ok := r.string()
+	if !ok || len(r) == 0 || r[0] != msgUserAuthRequest {
+		return SignRequest{}, false
+	}
+	r = r[1:]
+
+	user, ok1 := r.string()
+	service, ok2 := r.string()
+	method, ok3 := r.string()
+	if !ok1 || !ok2 || !ok3 || string(method) != "publickey" || len(r) == 0 {
+		return SignRequest{}, false
+	}
+	r = r[1:]
+
+	algorithm, ok := r.string()
+	if !ok {
+		return SignRequest{}, false
+	}
+
+	return SignRequest{
+		Kind:      SignRequestUserAuth,
+		User:      string(user),
+		Service:   string(service),
+		Algorithm: string(algorithm),
+		SessionID: sessionID,
+	}, true
+}
+
+func decodeSSHSig(data []byte) (SignRequest, bool) {
+	if !bytes.HasPrefix(data, sshSigMagic) {
+		return SignRequest{}, false
+	}
+	r := wireReader(data[len(sshSigMagic):])
+
+	namespace, ok1 := r.string()
+	_, ok2 := r.string()
+	hashAlgorithm, ok3 := r.string()
+	if !ok1 || !ok2 || !ok3 {
+		return SignRequest{}, false
+	}
+
+	return SignRequest{
+		Kind:          SignRequestSSHSig,
+		Namespace:     string(namespace),
+		HashAlgorithm: string(hashAlgorithm),
+	}, true
+}
+
+// wireReader read ssh wire format strings
+type wireReader []byte
+
+func (r *wireReader) string() ([]byte, bool) {
+	if len(*r) < 4 {
+		return nil, false
+	}
+
+	n := binary.BigEndian.Uint32(*r)
+	if uint64(len(*r)-4) < uint64(n) {
+		return nil, false
+	}
+
+	s := (*r)[4 : 4+n]
+	*r = (*r)[4+n:]
+	return s, true
+}
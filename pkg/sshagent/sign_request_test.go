@@ -0,0 +1,61 @@
+package sshagent
+
+import (
+	"reflect"
+	"testing"
+
+	"golang.org/x/crypto/ssh"
+)
+
+func TestDecodeSignRequest(t *testing.T) {
+	userAuth := ssh.Marshal(struct {
+		SessionID []byte
+		Type      byte
+		User      string
+		Service   string
+		Method    string
+		HasSig    bool
+		Algorithm string
+		PublicKey []byte
+	}{[]byte("session"), msgUserAuthRequest, "git", "ssh-connection", "publickey", true, ssh.KeyAlgoED25519, []byte("key")})
+
+	sshSig := append([]byte("SSHSIG"), ssh.Marshal(struct {
+		Namespace     string
+		Reserved      string
+		HashAlgorithm string
+		Hash          []byte
+	}{"git", "", "sha512", []byte("hash")})...)
+
+	passwordAuth := ssh.Marshal(struct {
+		SessionID []byte
+		Type      byte
+		User      string
+		Service   string
+		Method    string
+	}{[]byte("session"), msgUserAuthRequest, "git", "ssh-connection", "password"})
+
+	tests := map[string]struct {
+		data []byte
+		want SignRequest
+	}{
+		"userauth": {userAuth, SignRequest{
+			Kind:      SignRequestUserAuth,
+			User:      "git",
+			Service:   "ssh-connection",
+			Algorithm: ssh.KeyAlgoED25519,
+			SessionID: []byte("session"),
+		}},
+		"sshsig":           {sshSig, SignRequest{Kind: SignRequestSSHSig, Namespace: "git", HashAlgorithm: "sha512"}},
+		"not publickey":    {passwordAuth, SignRequest{Kind: SignRequestUnknown}},
+		"truncated":        {userAuth[:len(userAuth)/2], SignRequest{Kind: SignRequestUnknown}},
+		"truncated sshsig": {sshSig[:10], SignRequest{Kind: SignRequestUnknown}},
+		"empty":            {nil, SignRequest{Kind: SignRequestUnknown}},
+		"random":           {[]byte("\xff\xff\xff\xffdata"), SignRequest{Kind: SignRequestUnknown}},
+	}
+
+	for name, tt := range tests {
+		if got := decodeSignRequest(tt.data); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%s: decoded %+v, want %+v", name, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,52 @@
+package sshagent
+
+import (
+	"fmt"
+	"io"
+
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/agent"
+)
+
+// agentSigner route every signature back through SSHAgent.SignWithFlags,
+// so it stays usable after the upstream connection it was listed from is gone.
+type agentSigner struct {
+	agent *SSHAgent
+	pub   ssh.PublicKey
+}
+
+func (s *agentSigner) PublicKey() ssh.PublicKey {
+	return s.pub
+}
+
+func (s *agentSigner) Sign(rand io.Reader, data []byte) (*ssh.Signature, error) {
+	// the backend agent has its own entropy source, so the rand argument is ignored
+	return s.agent.SignWithFlags(s.pub, data, 0)
+}
+
+func (s *agentSigner) SignWithAlgorithm(rand io.Reader, data []byte, algorithm string) (*ssh.Signature, error) {
+	if algorithm == "" || algorithm == underlyingAlgo(s.pub) {
+		return s.Sign(rand, data)
+	}
+
+	var flags agent.SignatureFlags
+	switch algorithm {
+	case ssh.KeyAlgoRSASHA256:
+		flags = agent.SignatureFlagRsaSha256
+	case ssh.KeyAlgoRSASHA512:
+		flags = agent.SignatureFlagRsaSha512
+	default:
+		return nil, fmt.Errorf("agent: unsupported algorithm %q", algorithm)
+	}
+
+	return s.agent.SignWithFlags(s.pub, data, flags)
+}
+
+// underlyingAlgo return the signature algorithm of the key, certificates use the algorithm of their key
+func underlyingAlgo(pub ssh.PublicKey) string {
+	if cert, ok := pub.(*ssh.Certificate); ok {
+		return cert.Key.Type()
+	}
+
+	return pub.Type()
+}
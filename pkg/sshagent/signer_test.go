@@ -0,0 +1,42 @@
+package sshagent
+
+import (
+	"context"
+	"crypto/rand"
+	"path/filepath"
+	"testing"
+)
+
+func TestSignersAfterList(t *testing.T) {
+	socket, upstream := testUpstream(t)
+
+	a := NewSSHAgent(context.Background(), socket, filepath.Join(t.TempDir(), "agent.sock"))
+	defer a.Close()
+	addTestKey(t, upstream, "upstream")
+	addTestKey(t, a, "local")
+
+	signers, err := a.Signers()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(signers) != 2 {
+		t.Fatalf("got %d signers, want 2", len(signers))
+	}
+
+	// the connection the keys were listed from is gone, and the agent was listed again
+	a.upstreamAgents[0].setUpstream(UnixUpstream(socket))
+	if _, err = a.List(); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, signer := range signers {
+		data := []byte("data")
+		signature, err := signer.Sign(rand.Reader, data)
+		if err != nil {
+			t.Fatalf("sign with %s: %v", signer.PublicKey().Type(), err)
+		}
+		if err = signer.PublicKey().Verify(data, signature); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
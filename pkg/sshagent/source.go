@@ -0,0 +1,158 @@
+package sshagent
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/agent"
+)
+
+// KeySourceKind where a key came from
+type KeySourceKind string
+
+const (
+	// KeySourceFile the key was loaded from a key file by LoadLocalKeys
+	KeySourceFile KeySourceKind = "file"
+	// KeySourceClient the key was added by a client over the agent protocol, e.g. ssh-add
+	KeySourceClient KeySourceKind = "client"
+	// KeySourceAPI the key was added by calling Add in process
+	KeySourceAPI KeySourceKind = "api"
+	// KeySourceUpstream the key is held by an upstream agent
+	KeySourceUpstream KeySourceKind = "upstream"
+)
+
+// KeySource the provenance of a key
+type KeySource struct {
+	Kind KeySourceKind
+	// File the key file, for KeySourceFile
+	File string
+	// Peer the client which added the key, for KeySourceClient
+	Peer *Peer
+	// Upstream the name of the upstream agent, for KeySourceUpstream
+	Upstream string
+	// Added when the key was added, zero for upstream keys
+	Added time.Time
+}
+
+func (s KeySource) String() string {
+	switch s.Kind {
+	case KeySourceFile:
+		return fmt.Sprintf("file %s", s.File)
+	case KeySourceClient:
+		if s.Peer != nil {
+			return fmt.Sprintf("client %s", s.Peer)
+		}
+		return "client"
+	case KeySourceUpstream:
+		return fmt.Sprintf("upstream %s", s.Upstream)
+	default:
+		return string(s.Kind)
+	}
+}
+
+// Identity a listed key with its provenance
+type Identity struct {
+	*agent.Key
+	Source KeySource
+}
+
+type keySources struct {
+	mu      sync.RWMutex
+	sources map[string]KeySource
+}
+
+func (s *SSHAgent) setSource(key ssh.PublicKey, source KeySource) {
+	s.sources.mu.Lock()
+	defer s.sources.mu.Unlock()
+
+	if s.sources.sources == nil {
+		s.sources.sources = make(map[string]KeySource)
+	}
+	s.sources.sources[ssh.FingerprintSHA256(key)] = source
+}
+
+func (s *SSHAgent) sourceOf(key ssh.PublicKey) (KeySource, bool) {
+	s.sources.mu.RLock()
+	defer s.sources.mu.RUnlock()
+
+	source, ok := s.sources.sources[ssh.FingerprintSHA256(key)]
+	return source, ok
+}
+
+func (s *SSHAgent) deleteSource(key ssh.PublicKey) {
+	s.sources.mu.Lock()
+	defer s.sources.mu.Unlock()
+
+	delete(s.sources.sources, ssh.FingerprintSHA256(key))
+}
+
+func (s *SSHAgent) clearSources() {
+	s.sources.mu.Lock()
+	defer s.sources.mu.Unlock()
+
+	s.sources.sources = nil
+}
+
+// fileSource the source of keys loaded from the key file
+func fileSource(file string) KeySource {
+	return KeySource{Kind: KeySourceFile, File: file, Added: time.Now()}
+}
+
+// Identities list all keys like List, together with where each key came from
+func (s *SSHAgent) Identities(ctx context.Context) ([]Identity, error) {
+	return s.listIdentities(ctx)
+}
+
+// localSource return the source of a local key, keys without record were added in process
+func (s *SSHAgent) localSource(key ssh.PublicKey) KeySource {
+	if source, ok := s.sourceOf(key); ok {
+		return source
+	}
+
+	return KeySource{Kind: KeySourceAPI}
+}
+
+// RemoveBySource remove the local keys whose source match, and return how many keys were removed
+func (s *SSHAgent) RemoveBySource(match func(source KeySource) bool) (int, error) {
+	if s.lock.isLocked() {
+		return 0, ErrLocked
+	}
+
+	return s.removeBySource(match), nil
+}
+
+// RemoveFile remove the local keys loaded from the key file, and return how many keys were removed
+func (s *SSHAgent) RemoveFile(file string) (int, error) {
+	return s.RemoveBySource(func(source KeySource) bool {
+		return source.Kind == KeySourceFile && source.File == file
+	})
+}
+
+func (s *SSHAgent) removeBySource(match func(source KeySource) bool) int {
+	lks, err := s.localAgent.List()
+	if err != nil {
+		return 0
+	}
+
+	removed := 0
+	for _, k := range append(lks, s.lazy.list(time.Now())...) {
+		source, ok := s.sourceOf(k)
+		if !ok || !match(source) {
+			continue
+		}
+
+		pub, err := ssh.ParsePublicKey(k.Blob)
+		if err != nil {
+			continue
+		}
+
+		if err = s.removeLocal(pub); err == nil {
+			removed++
+		}
+	}
+
+	return removed
+}
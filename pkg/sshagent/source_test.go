@@ -0,0 +1,117 @@
+package sshagent
+
+import (
+	"context"
+	"crypto/ed25519"
+	"crypto/rand"
+	"errors"
+	"path/filepath"
+	"testing"
+
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/agent"
+)
+
+func TestRemoveBySource(t *testing.T) {
+	socket, upstream := testUpstream(t)
+
+	a := NewSSHAgent(context.Background(), socket, filepath.Join(t.TempDir(), "agent.sock"))
+	defer a.Close()
+	a.SetPassphraseProvider(testPassphrase("secret"), 1)
+
+	dir := t.TempDir()
+	file, lazyFile := filepath.Join(dir, "id_plain"), filepath.Join(dir, "id_lazy")
+	fileKey := writeTestKey(t, file)
+	lazyKey := writeEncryptedTestKey(t, lazyFile, []byte("secret"))
+	a.LoadLocalKeys(file, lazyFile)
+
+	upstreamKey := addTestKey(t, upstream, "upstream")
+	apiKey := addTestKey(t, a, "api")
+
+	// a key added by ssh-add over the agent protocol
+	peer := Peer{PID: 42, UID: 1000}
+	_, priv, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = a.forPeer(peer, true).Add(agent.AddedKey{PrivateKey: priv}); err != nil {
+		t.Fatal(err)
+	}
+	signer, err := ssh.NewSignerFromKey(priv)
+	if err != nil {
+		t.Fatal(err)
+	}
+	clientKey := signer.PublicKey()
+
+	sources := func() map[string]KeySource {
+		t.Helper()
+
+		identities, err := a.Identities(context.Background())
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		sources := make(map[string]KeySource, len(identities))
+		for _, id := range identities {
+			sources[ssh.FingerprintSHA256(id)] = id.Source
+		}
+		return sources
+	}
+
+	got := sources()
+	want := []struct {
+		key    ssh.PublicKey
+		source KeySource
+	}{
+		{upstreamKey, KeySource{Kind: KeySourceUpstream, Upstream: socket}},
+		{fileKey, KeySource{Kind: KeySourceFile, File: file}},
+		{lazyKey, KeySource{Kind: KeySourceFile, File: lazyFile}},
+		{apiKey, KeySource{Kind: KeySourceAPI}},
+		{clientKey, KeySource{Kind: KeySourceClient, Peer: &peer}},
+	}
+	if len(got) != len(want) {
+		t.Fatalf("listed %d identities, want %d", len(got), len(want))
+	}
+	for _, tt := range want {
+		g, w := got[ssh.FingerprintSHA256(tt.key)], tt.source
+		if g.Kind != w.Kind || g.File != w.File || g.Upstream != w.Upstream || (w.Peer != nil) != (g.Peer != nil) || (w.Peer != nil && *g.Peer != *w.Peer) {
+			t.Errorf("source of %s is %v, want %v", w.Kind, g, w)
+		}
+	}
+
+	// the lazy key is removed before it was ever decrypted
+	for _, f := range []string{file, lazyFile} {
+		if removed, err := a.RemoveFile(f); err != nil || removed != 1 {
+			t.Fatalf("remove %s: removed %d, err %v", f, removed, err)
+		}
+	}
+
+	got = sources()
+	for _, key := range []ssh.PublicKey{fileKey, lazyKey} {
+		if _, ok := got[ssh.FingerprintSHA256(key)]; ok {
+			t.Error("key of a removed file is still listed")
+		}
+	}
+	for _, key := range []ssh.PublicKey{upstreamKey, apiKey, clientKey} {
+		if _, ok := got[ssh.FingerprintSHA256(key)]; !ok {
+			t.Error("key of another source was removed with the files")
+		}
+	}
+
+	removed, err := a.RemoveBySource(func(source KeySource) bool {
+		return source.Kind == KeySourceClient && source.Peer != nil && source.Peer.PID == peer.PID
+	})
+	if err != nil || removed != 1 {
+		t.Fatalf("remove client keys: removed %d, err %v", removed, err)
+	}
+	if _, ok := sources()[ssh.FingerprintSHA256(clientKey)]; ok {
+		t.Fatal("client key is still listed")
+	}
+
+	if err = a.Lock([]byte("lock")); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = a.RemoveFile(file); !errors.Is(err, ErrLocked) {
+		t.Fatalf("remove from a locked agent: got %v, want ErrLocked", err)
+	}
+}
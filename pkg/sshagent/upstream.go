@@ -0,0 +1,173 @@
+package sshagent
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/agent"
+)
+
+// Upstream open connections speaking the ssh-agent protocol to an upstream agent
+type Upstream interface {
+	// Dial open a new connection, which is reused for many requests until it breaks
+	Dial(ctx context.Context) (io.ReadWriteCloser, error)
+	// String describe the upstream in status and errors
+	String() string
+}
+
+// UnixUpstream dial an agent listening on a unix socket, e.g. SSH_AUTH_SOCK
+func UnixUpstream(socket string) Upstream {
+	return &unixUpstream{
+		socket: socket,
+	}
+}
+
+type unixUpstream struct {
+	socket string
+}
+
+// errNoUpstreamSocket the upstream socket was empty, and the UpstreamResolver found no agent yet
+var errNoUpstreamSocket = errors.New("no upstream socket")
+
+func (u *unixUpstream) Dial(ctx context.Context) (io.ReadWriteCloser, error) {
+	if u.socket == "" {
+		return nil, errNoUpstreamSocket
+	}
+
+	var d net.Dialer
+	return d.DialContext(ctx, "unix", u.socket)
+}
+
+func (u *unixUpstream) String() string {
+	return u.socket
+}
+
+// TCPUpstream dial an agent listening on a TCP address
+func TCPUpstream(address string) Upstream {
+	return &tcpUpstream{
+		address: address,
+	}
+}
+
+type tcpUpstream struct {
+	address string
+}
+
+func (u *tcpUpstream) Dial(ctx context.Context) (io.ReadWriteCloser, error) {
+	var d net.Dialer
+	return d.DialContext(ctx, "tcp", u.address)
+}
+
+func (u *tcpUpstream) String() string {
+	return "tcp://" + u.address
+}
+
+// AgentUpstream serve an in-process agent, e.g. another agent.Keyring
+func AgentUpstream(a agent.Agent, name string) Upstream {
+	return &inProcessUpstream{
+		agent: a,
+		name:  name,
+	}
+}
+
+type inProcessUpstream struct {
+	agent agent.Agent
+	name  string
+}
+
+func (u *inProcessUpstream) Dial(context.Context) (io.ReadWriteCloser, error) {
+	client, server := net.Pipe()
+	go func() {
+		_ = agent.ServeAgent(u.agent, server)
+		_ = server.Close()
+	}()
+
+	return client, nil
+}
+
+func (u *inProcessUpstream) String() string {
+	return u.name
+}
+
+// channelTypeAgent the channel type of agent forwarding
+const channelTypeAgent = "auth-agent@openssh.com"
+
+// SSHUpstream open agent channels (auth-agent@openssh.com) to the client of a server connection,
+// i.e. the agent forwarded by a client connected to an ssh.NewServerConn, like sshd does for ssh -A.
+// A server refuse this channel from its clients, use SSHSocketUpstream on the client side of a connection.
+func SSHUpstream(conn ssh.Conn) Upstream {
+	return &sshUpstream{
+		conn: conn,
+	}
+}
+
+type sshUpstream struct {
+	conn ssh.Conn
+}
+
+func (u *sshUpstream) Dial(ctx context.Context) (io.ReadWriteCloser, error) {
+	type opened struct {
+		channel ssh.Channel
+		err     error
+	}
+
+	result := make(chan opened, 1)
+	go func() {
+		channel, reqs, err := u.conn.OpenChannel(channelTypeAgent, nil)
+		if err == nil {
+			go ssh.DiscardRequests(reqs)
+		}
+		result <- opened{channel, err}
+	}()
+
+	select {
+	case r := <-result:
+		if r.err != nil {
+			return nil, fmt.Errorf("failed to open agent channel: %w", r.err)
+		}
+		return r.channel, nil
+	case <-ctx.Done():
+		// the client may still accept the channel, close it once it does
+		go func() {
+			if r := <-result; r.err == nil {
+				_ = r.channel.Close()
+			}
+		}()
+		return nil, fmt.Errorf("failed to open agent channel: %w", ctx.Err())
+	}
+}
+
+func (u *sshUpstream) String() string {
+	return "ssh://" + u.conn.RemoteAddr().String()
+}
+
+// SSHSocketUpstream dial an agent socket of the remote host over a client connection (direct-streamlocal@openssh.com),
+// e.g. the SSH_AUTH_SOCK of the remote session. The server must allow stream local forwarding.
+func SSHSocketUpstream(client *ssh.Client, socket string) Upstream {
+	return &sshSocketUpstream{
+		client: client,
+		socket: socket,
+	}
+}
+
+type sshSocketUpstream struct {
+	client *ssh.Client
+	socket string
+}
+
+func (u *sshSocketUpstream) Dial(ctx context.Context) (io.ReadWriteCloser, error) {
+	conn, err := u.client.DialContext(ctx, "unix", u.socket)
+	if err != nil {
+		return nil, fmt.Errorf("failed to dial remote agent socket: %w", err)
+	}
+
+	return conn, nil
+}
+
+func (u *sshSocketUpstream) String() string {
+	return "ssh://" + u.client.RemoteAddr().String() + u.socket
+}
@@ -1,72 +1,269 @@
 package sshagent
 
 import (
+	"bytes"
+	"context"
+	"errors"
 	"fmt"
-	"io"
 	"net"
+	"sync"
+	"time"
 
 	"golang.org/x/crypto/ssh"
 	"golang.org/x/crypto/ssh/agent"
 )
 
+const (
+	// maxIdleUpstreamConns the number of persistent connections kept per upstream
+	maxIdleUpstreamConns = 4
+	// upstreamIdleTimeout persistent connections unused for longer are re-dialed
+	upstreamIdleTimeout = 5 * time.Minute
+)
+
+// upstreamAgent keep a small pool of long-lived connections to the upstream agent.
+// Every call borrows a connection for its exclusive use, so concurrent client connections never share an agent client.
 type upstreamAgent struct {
-	conn   net.Conn
-	agent  agent.ExtendedAgent
-	socket string
-	io.Closer
+	mu       sync.Mutex
+	upstream Upstream
+	idle     []*upstreamClient
+	conns    map[*upstreamClient]struct{}
+	closed   bool
+
+	health UpstreamStatus
+
+	// rediscover is called when dialing fails, and report whether the upstream was swapped
+	rediscover func(u *upstreamAgent) bool
+}
+
+func newUpstreamAgent(upstream Upstream, rediscover func(u *upstreamAgent) bool) *upstreamAgent {
+	u := &upstreamAgent{
+		conns:      make(map[*upstreamClient]struct{}),
+		rediscover: rediscover,
+	}
+	u.setUpstream(upstream)
+
+	return u
+}
+
+func (u *upstreamAgent) current() Upstream {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+
+	return u.upstream
 }
 
-func newUpstreamAgent(socket string) *upstreamAgent {
-	return &upstreamAgent{
-		socket: socket,
+func (u *upstreamAgent) String() string {
+	return u.current().String()
+}
+
+// setUpstream swap the upstream. Idle connections are dropped, in-flight calls finish on the old upstream.
+func (u *upstreamAgent) setUpstream(upstream Upstream) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+
+	u.upstream = upstream
+	u.health.Name = upstream.String()
+	u.health.Socket = ""
+	if unix, ok := upstream.(*unixUpstream); ok {
+		u.health.Socket = unix.socket
 	}
+
+	for _, c := range u.idle {
+		delete(u.conns, c)
+		_ = c.conn.Close()
+	}
+	u.idle = nil
+}
+
+// upstreamClient an agent client over one persistent connection
+type upstreamClient struct {
+	agent.ExtendedAgent
+	conn     *trackedConn
+	upstream Upstream
+	lastUsed time.Time
+	// reused whether the connection was taken from the idle pool
+	reused bool
 }
 
-func (u *upstreamAgent) refresh() error {
-	conn, err := net.Dial("unix", u.socket)
+func (u *upstreamAgent) dial(ctx context.Context) (*upstreamClient, error) {
+	upstream := u.current()
+
+	conn, err := upstream.Dial(ctx)
 	if err != nil {
-		return fmt.Errorf("failed to dial upstream agent: %w", err)
+		return nil, fmt.Errorf("%w: %w", ErrUpstreamUnavailable, err)
 	}
 
-	u.conn = conn
-	u.agent = agent.NewClient(conn)
+	tc := &trackedConn{ReadWriteCloser: conn}
+	return &upstreamClient{
+		ExtendedAgent: agent.NewClient(tc),
+		conn:          tc,
+		upstream:      upstream,
+	}, nil
+}
 
-	return nil
+// get borrow a healthy idle connection, or dial a new one
+func (u *upstreamAgent) get(ctx context.Context) (*upstreamClient, error) {
+	u.mu.Lock()
+	if u.closed {
+		u.mu.Unlock()
+		return nil, fmt.Errorf("%w: %w", ErrUpstreamUnavailable, net.ErrClosed)
+	}
+
+	for len(u.idle) > 0 {
+		c := u.idle[len(u.idle)-1]
+		u.idle = u.idle[:len(u.idle)-1]
+
+		if time.Since(c.lastUsed) < upstreamIdleTimeout && c.conn.alive() {
+			u.mu.Unlock()
+			c.reused = true
+			return c, nil
+		}
+
+		delete(u.conns, c)
+		_ = c.conn.Close()
+	}
+	u.mu.Unlock()
+
+	c, err := u.dial(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	u.mu.Lock()
+	defer u.mu.Unlock()
+
+	if u.closed {
+		_ = c.conn.Close()
+		return nil, fmt.Errorf("%w: %w", ErrUpstreamUnavailable, net.ErrClosed)
+	}
+	u.conns[c] = struct{}{}
+
+	return c, nil
 }
 
-func (u *upstreamAgent) List() ([]*agent.Key, error) {
-	if err := u.refresh(); err != nil {
-		return []*agent.Key{}, nil
+// put return the connection to the pool, broken connections are closed
+func (u *upstreamAgent) put(c *upstreamClient) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+
+	if u.closed || c.conn.broken() || c.upstream != u.upstream || len(u.idle) >= maxIdleUpstreamConns {
+		delete(u.conns, c)
+		_ = c.conn.Close()
+		return
 	}
 
-	defer u.conn.Close()
+	c.lastUsed = time.Now()
+	u.idle = append(u.idle, c)
+}
+
+// do run a request bounded by ctx, retrying once on a fresh connection when the connection broke.
+// A request which is not idempotent is retried only when a reused idle connection broke before any reply,
+// so a sign the upstream may have received is never sent twice, e.g. showing a second approval prompt.
+// The connection is closed when ctx is done, because a late reply would desync the agent protocol.
+func (u *upstreamAgent) do(ctx context.Context, idempotent bool, fn func(client agent.ExtendedAgent) error) error {
+	for attempt := 0; ; attempt++ {
+		c, err := u.get(ctx)
+		if err != nil && ctx.Err() == nil && attempt == 0 && u.rediscover != nil && u.rediscover(u) {
+			continue
+		}
+		if err != nil {
+			err = ctxError(ctx, err)
+			u.report(err)
+			return err
+		}
+
+		stop := context.AfterFunc(ctx, func() {
+			c.conn.record(ctx.Err())
+			_ = c.conn.Close()
+		})
+		err = fn(c)
+		stop()
+		u.put(c)
+
+		if err != nil && ctx.Err() != nil {
+			err = ctxError(ctx, err)
+			u.report(err)
+			return err
+		}
 
-	return u.agent.List()
+		if err != nil && c.conn.broken() {
+			if attempt == 0 && (idempotent || (c.reused && !c.conn.replied())) {
+				continue
+			}
+
+			err = fmt.Errorf("%w: %w", ErrUpstreamUnavailable, err)
+			u.report(err)
+			return err
+		}
+
+		// the upstream answered, even a refused request means it is healthy
+		u.report(nil)
+		return err
+	}
 }
 
-func (u *upstreamAgent) Signers() (out []ssh.Signer, _ error) {
-	if err := u.refresh(); err != nil {
-		return []ssh.Signer{}, nil
+// ctxError turn an error caused by an expired ctx into ErrUpstreamTimeout
+func ctxError(ctx context.Context, err error) error {
+	if errors.Is(ctx.Err(), context.DeadlineExceeded) {
+		return fmt.Errorf("%w: %w", ErrUpstreamTimeout, err)
 	}
 
-	defer u.conn.Close()
+	if ctx.Err() != nil {
+		return fmt.Errorf("%w: %w", ctx.Err(), err)
+	}
 
-	return u.agent.Signers()
+	return err
 }
 
-func (u *upstreamAgent) SignWithFlags(key ssh.PublicKey, data []byte, flags agent.SignatureFlags) (*ssh.Signature, error) {
-	if err := u.refresh(); err != nil {
-		return nil, err
+func (u *upstreamAgent) List(ctx context.Context) (keys []*agent.Key, _ error) {
+	err := u.do(ctx, true, func(client agent.ExtendedAgent) (err error) {
+		keys, err = client.List()
+		return err
+	})
+	return keys, err
+}
+
+// has report whether the upstream currently holds the key
+func (u *upstreamAgent) has(ctx context.Context, key ssh.PublicKey) bool {
+	keys, err := u.List(ctx)
+	if err != nil {
+		return false
 	}
 
-	defer u.conn.Close()
+	return containsKey(keys, key)
+}
 
-	return u.agent.SignWithFlags(key, data, flags)
+func containsKey(keys []*agent.Key, key ssh.PublicKey) bool {
+	blob := key.Marshal()
+	for _, k := range keys {
+		if bytes.Equal(k.Blob, blob) {
+			return true
+		}
+	}
+
+	return false
+}
+
+func (u *upstreamAgent) SignWithFlags(ctx context.Context, key ssh.PublicKey, data []byte, flags agent.SignatureFlags) (signature *ssh.Signature, _ error) {
+	err := u.do(ctx, false, func(client agent.ExtendedAgent) (err error) {
+		signature, err = client.SignWithFlags(key, data, flags)
+		return err
+	})
+
+	return signature, err
 }
 
+// Close close all connections and refuse new calls
 func (u *upstreamAgent) Close() error {
-	if u.conn != nil {
-		return u.conn.Close()
+	u.mu.Lock()
+	defer u.mu.Unlock()
+
+	u.closed = true
+	u.idle = nil
+	for c := range u.conns {
+		_ = c.conn.Close()
+		delete(u.conns, c)
 	}
+
 	return nil
 }
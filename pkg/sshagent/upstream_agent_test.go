@@ -0,0 +1,68 @@
+package sshagent
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/ssh/agent"
+)
+
+// hangingUpstream accept connections on a unix socket and never answer
+func hangingUpstream(t *testing.T) string {
+	t.Helper()
+
+	socket := filepath.Join(t.TempDir(), "hanging.sock")
+	listener, err := net.Listen("unix", socket)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = listener.Close() })
+
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				_, _ = io.Copy(io.Discard, conn)
+			}()
+		}
+	}()
+
+	return socket
+}
+
+func TestHangingUpstreamTimeout(t *testing.T) {
+	a := NewSSHAgent(context.Background(), hangingUpstream(t), filepath.Join(t.TempDir(), "agent.sock"))
+	defer a.Close()
+
+	const timeout = 100 * time.Millisecond
+	a.SetListTimeout(timeout)
+	a.SetSignTimeout(timeout)
+
+	start := time.Now()
+	if _, err := a.List(); !errors.Is(err, ErrUpstreamTimeout) {
+		t.Fatalf("list: got %v, want ErrUpstreamTimeout", err)
+	}
+
+	// a key held by no backend scan the hanging upstream
+	key := addTestKey(t, agent.NewKeyring(), "unknown")
+	if _, err := a.Sign(key, []byte("data")); !errors.Is(err, ErrUpstreamTimeout) {
+		t.Fatalf("sign: got %v, want ErrUpstreamTimeout", err)
+	}
+
+	if elapsed := time.Since(start); elapsed > 20*timeout {
+		t.Fatalf("calls took %s, the timeout is %s", elapsed, timeout)
+	}
+
+	if status := a.UpstreamStatus(); len(status) != 1 || !errors.Is(status[0].LastError, ErrUpstreamTimeout) {
+		t.Fatalf("upstream status %+v, want the timeout recorded", status)
+	}
+}
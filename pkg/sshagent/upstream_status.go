@@ -0,0 +1,43 @@
+package sshagent
+
+import "time"
+
+// UpstreamStatus the health of an upstream agent
+type UpstreamStatus struct {
+	// Name describe the upstream, see Upstream.String
+	Name string
+	// Socket the path of the upstream socket, empty when the upstream is not a unix socket
+	Socket string
+	// Healthy whether the last call reached the upstream
+	Healthy bool
+	// LastError the error of the last failed call
+	LastError error
+	// LastErrorTime the time of the last failed call
+	LastErrorTime time.Time
+	// LastSuccess the time of the last call answered by the upstream
+	LastSuccess time.Time
+}
+
+// report record the outcome of a call, nil means the upstream answered
+func (u *upstreamAgent) report(err error) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+
+	now := time.Now()
+	if err == nil {
+		u.health.Healthy = true
+		u.health.LastSuccess = now
+		return
+	}
+
+	u.health.Healthy = false
+	u.health.LastError = err
+	u.health.LastErrorTime = now
+}
+
+func (u *upstreamAgent) status() UpstreamStatus {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+
+	return u.health
+}
@@ -0,0 +1,191 @@
+package sshagent
+
+import (
+	"context"
+	"crypto/ed25519"
+	"crypto/rand"
+	"errors"
+	"io"
+	"net"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/agent"
+)
+
+// sshPair the two ends of an in-process ssh connection
+type sshPair struct {
+	server      *ssh.ServerConn
+	serverChans <-chan ssh.NewChannel
+	client      ssh.Conn
+	clientChans <-chan ssh.NewChannel
+	clientReqs  <-chan *ssh.Request
+}
+
+// newSSHPair run the ssh handshake over a unix socket, global requests to the server are discarded
+func newSSHPair(t *testing.T) *sshPair {
+	t.Helper()
+
+	_, hostKey, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	hostSigner, err := ssh.NewSignerFromKey(hostKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	serverConfig := &ssh.ServerConfig{NoClientAuth: true}
+	serverConfig.AddHostKey(hostSigner)
+
+	listener, err := net.Listen("unix", filepath.Join(t.TempDir(), "ssh.sock"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+
+	pair := &sshPair{}
+	done := make(chan error, 1)
+	go func() {
+		conn, err := listener.Accept()
+		if err != nil {
+			done <- err
+			return
+		}
+		server, chans, reqs, err := ssh.NewServerConn(conn, serverConfig)
+		if err == nil {
+			go ssh.DiscardRequests(reqs)
+			pair.server, pair.serverChans = server, chans
+		}
+		done <- err
+	}()
+
+	conn, err := net.Dial("unix", listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	clientConfig := &ssh.ClientConfig{User: "test", HostKeyCallback: ssh.InsecureIgnoreHostKey()}
+	pair.client, pair.clientChans, pair.clientReqs, err = ssh.NewClientConn(conn, "unix", clientConfig)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = <-done; err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		_ = pair.client.Close()
+		_ = pair.server.Close()
+	})
+
+	return pair
+}
+
+// testUpstreamAgent list and sign through the upstream
+func testUpstreamAgent(t *testing.T, upstream Upstream, key ssh.PublicKey) {
+	t.Helper()
+
+	a := NewSSHAgentWithUpstreams(context.Background(), nil, filepath.Join(t.TempDir(), "agent.sock"))
+	defer a.Close()
+	a.AddUpstream(upstream)
+
+	keys, err := a.List()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !containsKey(keys, key) {
+		t.Fatalf("listed %d keys without the upstream key", len(keys))
+	}
+
+	signature, err := a.Sign(key, []byte("data"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = key.Verify([]byte("data"), signature); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestSSHUpstream(t *testing.T) {
+	pair := newSSHPair(t)
+	go func() {
+		for ch := range pair.serverChans {
+			_ = ch.Reject(ssh.Prohibited, "no channels")
+		}
+	}()
+
+	// the client forward its agent, like ssh -A
+	keyring := agent.NewKeyring()
+	key := addTestKey(t, keyring, "forwarded")
+	client := ssh.NewClient(pair.client, pair.clientChans, pair.clientReqs)
+	if err := agent.ForwardToAgent(client, keyring); err != nil {
+		t.Fatal(err)
+	}
+
+	testUpstreamAgent(t, SSHUpstream(pair.server), key)
+}
+
+func TestSSHSocketUpstream(t *testing.T) {
+	socket, keyring := testUpstream(t)
+	key := addTestKey(t, keyring, "remote")
+
+	pair := newSSHPair(t)
+	go func() {
+		for ch := range pair.serverChans {
+			if ch.ChannelType() != "direct-streamlocal@openssh.com" {
+				_ = ch.Reject(ssh.UnknownChannelType, "unsupported")
+				continue
+			}
+
+			var msg struct {
+				SocketPath string
+				Reserved0  string
+				Reserved1  uint32
+			}
+			if err := ssh.Unmarshal(ch.ExtraData(), &msg); err != nil || msg.SocketPath != socket {
+				_ = ch.Reject(ssh.ConnectionFailed, "unexpected socket")
+				continue
+			}
+
+			conn, err := net.Dial("unix", msg.SocketPath)
+			if err != nil {
+				_ = ch.Reject(ssh.ConnectionFailed, err.Error())
+				continue
+			}
+			channel, reqs, err := ch.Accept()
+			if err != nil {
+				_ = conn.Close()
+				continue
+			}
+			go ssh.DiscardRequests(reqs)
+			go func() {
+				_, _ = io.Copy(conn, channel)
+				_ = conn.Close()
+			}()
+			go func() {
+				_, _ = io.Copy(channel, conn)
+				_ = channel.Close()
+			}()
+		}
+	}()
+
+	client := ssh.NewClient(pair.client, pair.clientChans, pair.clientReqs)
+	testUpstreamAgent(t, SSHSocketUpstream(client, socket), key)
+}
+
+func TestSSHUpstreamDialContext(t *testing.T) {
+	// the client never answer the channel open
+	pair := newSSHPair(t)
+	go ssh.DiscardRequests(pair.clientReqs)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+
+	start := time.Now()
+	if _, err := SSHUpstream(pair.server).Dial(ctx); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("dial: got %v, want context.DeadlineExceeded", err)
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Fatalf("dial returned after %s", elapsed)
+	}
+}
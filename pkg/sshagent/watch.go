@@ -0,0 +1,149 @@
+package sshagent
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/oomol-lab/ovm-ssh-agent/v3/pkg/identity"
+)
+
+const (
+	// DefaultWatchInterval how often key files are rescanned when the platform has no file notification
+	DefaultWatchInterval = 2 * time.Second
+	// watchResyncInterval how often key files are rescanned with file notification, to catch files outside the watched directories
+	watchResyncInterval = time.Minute
+	// watchDebounce coalesce the burst of notifications caused by one change
+	watchDebounce = 250 * time.Millisecond
+)
+
+// WatchOptions control the hot reload of local keys
+type WatchOptions struct {
+	// Dirs the directories watched for changes, with their subdirectories, empty watch ~/.ssh
+	Dirs []string
+	// Discover return the key files to load with their -cert.pub certificates, ignored when DiscoverKeys is set
+	Discover func() []string
+	// DiscoverKeys return the keys to load with their certificates, nil use identity.DiscoverKeys unless Discover is set
+	DiscoverKeys func() []identity.KeyInfo
+	// Interval the polling interval when the platform has no file notification, zero use DefaultWatchInterval
+	Interval time.Duration
+}
+
+// dirWatcher notify about changes in directories
+type dirWatcher interface {
+	// Events receive a value after something changed in a watched directory
+	Events() <-chan struct{}
+	// Add watch the directories, already watched directories are ignored
+	Add(dirs []string)
+	Close() error
+}
+
+// WatchLocalKeys keep the local keys in sync with the key files until Close.
+// New key files are loaded, and the keys of deleted or changed files are removed, changed files are loaded again.
+// Keys added by clients are never touched. Uses inotify on Linux, and polling on other platforms.
+func (s *SSHAgent) WatchLocalKeys(opts WatchOptions) {
+	if opts.DiscoverKeys == nil {
+		opts.DiscoverKeys = identity.DiscoverKeys
+		if discover := opts.Discover; discover != nil {
+			opts.DiscoverKeys = func() []identity.KeyInfo {
+				var keys []identity.KeyInfo
+				for _, file := range discover() {
+					keys = append(keys, identity.KeyInfo{Path: file})
+				}
+				return keys
+			}
+		}
+	}
+	if opts.Interval <= 0 {
+		opts.Interval = DefaultWatchInterval
+	}
+	if len(opts.Dirs) == 0 {
+		if homeDir, err := os.UserHomeDir(); err == nil {
+			opts.Dirs = []string{filepath.Join(homeDir, ".ssh")}
+		}
+	}
+
+	go s.watchLocalKeys(opts)
+}
+
+func (s *SSHAgent) watchLocalKeys(opts WatchOptions) {
+	var events <-chan struct{}
+	interval := opts.Interval
+
+	watcher, err := newDirWatcher()
+	if err == nil {
+		defer watcher.Close()
+
+		events = watcher.Events()
+		interval = watchResyncInterval
+	}
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		if !s.lock.isLocked() && !s.isCleared() {
+			discovered := keyFilesOf(opts.DiscoverKeys())
+			if watcher != nil {
+				watcher.Add(append(watchedDirs(opts.Dirs), keyFileDirs(discovered)...))
+			}
+
+			loaded, unloaded := s.syncLocalFiles(discovered)
+			if loaded > 0 || unloaded > 0 {
+				s.emit(EventLocalKeysChanged, fmt.Sprintf("%d key files loaded, %d unloaded", loaded, unloaded))
+			}
+		}
+
+		select {
+		case <-s.context.Done():
+			return
+		case <-ticker.C:
+		case <-events:
+			// wait for the rest of the change, e.g. the certificate written after the key
+			time.Sleep(watchDebounce)
+			drain(events)
+		}
+	}
+}
+
+func drain(events <-chan struct{}) {
+	for {
+		select {
+		case <-events:
+		default:
+			return
+		}
+	}
+}
+
+// keyFileDirs return the directories of the key and certificate files, which may be outside the watched directories
+func keyFileDirs(files []keyFile) []string {
+	dirs := make([]string, 0, len(files))
+	for _, f := range files {
+		dirs = append(dirs, filepath.Dir(f.path))
+		if f.certPath != "" {
+			dirs = append(dirs, filepath.Dir(f.certPath))
+		}
+	}
+
+	return dirs
+}
+
+// watchedDirs return the directories and all their subdirectories
+func watchedDirs(roots []string) []string {
+	var dirs []string
+	for _, root := range roots {
+		_ = filepath.WalkDir(root, func(path string, d os.DirEntry, err error) error {
+			if err != nil {
+				return filepath.SkipDir
+			}
+			if d.IsDir() {
+				dirs = append(dirs, path)
+			}
+			return nil
+		})
+	}
+
+	return dirs
+}
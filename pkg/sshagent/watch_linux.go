@@ -0,0 +1,106 @@
+package sshagent
+
+import (
+	"os"
+	"sync"
+	"syscall"
+	"unsafe"
+)
+
+const inotifyMask = syscall.IN_CREATE | syscall.IN_DELETE | syscall.IN_MODIFY | syscall.IN_ATTRIB |
+	syscall.IN_MOVED_FROM | syscall.IN_MOVED_TO | syscall.IN_CLOSE_WRITE | syscall.IN_DELETE_SELF
+
+// inotifyWatcher watch directories with inotify, the fd is non-blocking so Close interrupt the reader.
+// file.Fd() must not be called, it would switch the fd back to blocking mode.
+type inotifyWatcher struct {
+	fd     int
+	file   *os.File
+	events chan struct{}
+
+	mu sync.Mutex
+	// watched the watch descriptor of each directory
+	watched map[string]int32
+}
+
+func newDirWatcher() (dirWatcher, error) {
+	fd, err := syscall.InotifyInit1(syscall.IN_CLOEXEC | syscall.IN_NONBLOCK)
+	if err != nil {
+		return nil, os.NewSyscallError("inotify_init1", err)
+	}
+
+	w := &inotifyWatcher{
+		fd:      fd,
+		file:    os.NewFile(uintptr(fd), "inotify"),
+		events:  make(chan struct{}, 1),
+		watched: make(map[string]int32),
+	}
+	go w.read()
+
+	return w, nil
+}
+
+func (w *inotifyWatcher) read() {
+	buf := make([]byte, 64*(syscall.SizeofInotifyEvent+syscall.NAME_MAX+1))
+	for {
+		n, err := w.file.Read(buf)
+		if err != nil {
+			return
+		}
+		w.handle(buf[:n])
+
+		select {
+		case w.events <- struct{}{}:
+		default:
+		}
+	}
+}
+
+// handle forget the watches removed by the kernel, e.g. of a deleted directory, so Add watch a recreated directory again
+func (w *inotifyWatcher) handle(buf []byte) {
+	for len(buf) >= syscall.SizeofInotifyEvent {
+		event := (*syscall.InotifyEvent)(unsafe.Pointer(&buf[0]))
+		size := syscall.SizeofInotifyEvent + int(event.Len)
+		if size > len(buf) {
+			return
+		}
+
+		if event.Mask&syscall.IN_IGNORED != 0 {
+			w.forget(event.Wd)
+		}
+		buf = buf[size:]
+	}
+}
+
+func (w *inotifyWatcher) forget(wd int32) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	for dir, d := range w.watched {
+		if d == wd {
+			delete(w.watched, dir)
+		}
+	}
+}
+
+func (w *inotifyWatcher) Events() <-chan struct{} {
+	return w.events
+}
+
+func (w *inotifyWatcher) Add(dirs []string) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	for _, dir := range dirs {
+		if _, ok := w.watched[dir]; ok {
+			continue
+		}
+
+		if wd, err := syscall.InotifyAddWatch(w.fd, dir, inotifyMask); err == nil {
+			w.watched[dir] = int32(wd)
+		}
+	}
+}
+
+func (w *inotifyWatcher) Close() error {
+	return w.file.Close()
+}
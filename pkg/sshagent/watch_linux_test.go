@@ -0,0 +1,62 @@
+package sshagent
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestInotifyWatchRecreatedDir(t *testing.T) {
+	watcher, err := newDirWatcher()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer watcher.Close()
+	w := watcher.(*inotifyWatcher)
+
+	isWatched := func(dir string) bool {
+		w.mu.Lock()
+		defer w.mu.Unlock()
+
+		_, ok := w.watched[dir]
+		return ok
+	}
+	waitEvent := func() {
+		t.Helper()
+
+		select {
+		case <-w.Events():
+		case <-time.After(5 * time.Second):
+			t.Fatal("no event after a change in the watched directory")
+		}
+	}
+
+	dir := filepath.Join(t.TempDir(), "keys")
+	if err = os.Mkdir(dir, 0o700); err != nil {
+		t.Fatal(err)
+	}
+	w.Add([]string{dir})
+
+	if err = os.Remove(dir); err != nil {
+		t.Fatal(err)
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	for isWatched(dir) {
+		if time.Now().After(deadline) {
+			t.Fatal("the watch of the deleted directory was not dropped")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	drain(w.Events())
+
+	// the recreated directory is a new inode, it must be watched again
+	if err = os.Mkdir(dir, 0o700); err != nil {
+		t.Fatal(err)
+	}
+	w.Add([]string{dir})
+	if err = os.WriteFile(filepath.Join(dir, "id_ed25519"), nil, 0o600); err != nil {
+		t.Fatal(err)
+	}
+	waitEvent()
+}
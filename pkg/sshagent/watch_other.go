@@ -0,0 +1,9 @@
+//go:build !linux
+
+package sshagent
+
+import "errors"
+
+func newDirWatcher() (dirWatcher, error) {
+	return nil, errors.New("file notification not supported")
+}
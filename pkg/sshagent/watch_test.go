@@ -0,0 +1,83 @@
+package sshagent
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// waitKeys wait until the local agent hold exactly the keys
+func waitKeys(t *testing.T, a *SSHAgent, want ...ssh.PublicKey) {
+	t.Helper()
+
+	deadline := time.Now().Add(10 * time.Second)
+	for {
+		keys, err := a.localAgent.List()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		held := len(keys) == len(want)
+		for _, key := range want {
+			held = held && containsKey(keys, key)
+		}
+		if held {
+			return
+		}
+
+		if time.Now().After(deadline) {
+			t.Fatalf("local agent hold %d keys, want %d", len(keys), len(want))
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+}
+
+func TestWatchLocalKeys(t *testing.T) {
+	a := NewSSHAgent(context.Background(), "", filepath.Join(t.TempDir(), "agent.sock"))
+	defer a.Close()
+
+	dir := t.TempDir()
+	discovered := filepath.Join(dir, "id_discovered")
+	explicit := filepath.Join(dir, "id_explicit")
+	discoveredKey := writeTestKey(t, discovered)
+	explicitKey := writeTestKey(t, explicit)
+
+	a.LoadLocalKeys(explicit)
+	a.WatchLocalKeys(WatchOptions{
+		Dirs:     []string{dir},
+		Discover: func() []string { return []string{discovered} },
+		Interval: 50 * time.Millisecond,
+	})
+
+	// the explicitly loaded key is not discovered, but it is kept
+	waitKeys(t, a, explicitKey, discoveredKey)
+
+	time.Sleep(10 * time.Millisecond)
+	changedKey := writeTestKey(t, discovered)
+	waitKeys(t, a, explicitKey, changedKey)
+
+	if err := os.Remove(discovered); err != nil {
+		t.Fatal(err)
+	}
+	waitKeys(t, a, explicitKey)
+
+	if err := os.Remove(explicit); err != nil {
+		t.Fatal(err)
+	}
+	waitKeys(t, a)
+}
+
+func TestSyncLocalFilesMissing(t *testing.T) {
+	a := NewSSHAgent(context.Background(), "", filepath.Join(t.TempDir(), "agent.sock"))
+	defer a.Close()
+
+	// a file which never existed was never loaded, so it is never reported as unloaded
+	a.LoadLocalKeys(filepath.Join(t.TempDir(), "id_missing"))
+	if loaded, unloaded := a.syncLocalFiles(nil); loaded != 0 || unloaded != 0 {
+		t.Fatalf("missing file: %d loaded, %d unloaded, want none", loaded, unloaded)
+	}
+}